@@ -0,0 +1,34 @@
+// Copyright (C) 2022  The pages authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package acme
+
+import (
+	"time"
+)
+
+// Config defines how certificates are obtained from an ACME (RFC 8555) directory for the hosted sites.
+type Config struct {
+	Enable       bool          `json:"enable"        usage:"obtain certificates for every site from an ACME directory, accepting its terms of service"`
+	Email        string        `json:"email"         usage:"the contact email registered with the ACME account"`
+	DirectoryURL string        `json:"directory_url" usage:"the ACME directory certificates are requested from" default:"https://acme-v02.api.letsencrypt.org/directory"`
+	CAFile       string        `json:"ca_file"       usage:"path to a PEM encoded CA used to verify the ACME directory (e.g. when testing against pebble)"`
+	Storage      string        `json:"storage"       usage:"the directory certificates and account keys are stored in" default:"acme"`
+	RenewBefore  time.Duration `json:"renew_before"  usage:"how long before they expire certificates are renewed" default:"720h"`
+
+	// Domains are the hostnames certificates may be issued for. Requests for any other host are rejected.
+	Domains []string `json:"-"`
+}
@@ -0,0 +1,118 @@
+// Copyright (C) 2022  The pages authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package acme
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"os"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// Option customizes the autocert.Manager constructed by New.
+type Option func(manager *autocert.Manager)
+
+// Cache overrides where certificates, account keys, and HTTP-01 challenge tokens are stored. Replicas that share a
+// cache are able to answer the challenges for certificates requested by one another.
+func Cache(cache autocert.Cache) Option {
+	return func(manager *autocert.Manager) {
+		manager.Cache = cache
+	}
+}
+
+// New constructs an autocert.Manager that issues certificates for the configured domains, storing them on disk and
+// renewing them ahead of their expiry. Certificates are requested on the first handshake for a domain and validated
+// using either the TLS-ALPN-01 or HTTP-01 challenge. Nil is returned when ACME is not enabled.
+func New(cfg Config, opts ...Option) (*autocert.Manager, error) {
+	if !cfg.Enable {
+		return nil, nil
+	}
+
+	if len(cfg.Domains) == 0 {
+		return nil, errors.New("acme requires at least one site with a domain that is not a wildcard")
+	}
+
+	client := &acme.Client{
+		DirectoryURL: cfg.DirectoryURL,
+	}
+
+	if cfg.CAFile != "" {
+		pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read acme ca file")
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.Errorf("no certificates found in %s", cfg.CAFile)
+		}
+
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{
+			MinVersion: tls.VersionTLS12,
+			RootCAs:    pool,
+		}
+
+		client.HTTPClient = &http.Client{Transport: transport}
+	}
+
+	manager := &autocert.Manager{
+		Prompt:      autocert.AcceptTOS,
+		Cache:       autocert.DirCache(cfg.Storage),
+		HostPolicy:  autocert.HostWhitelist(cfg.Domains...),
+		RenewBefore: cfg.RenewBefore,
+		Client:      client,
+		Email:       cfg.Email,
+	}
+
+	for _, opt := range opts {
+		opt(manager)
+	}
+
+	return manager, nil
+}
+
+// TLSConfig returns a tls.Config that serves the certificates issued by the manager and answers TLS-ALPN-01
+// challenges. Certificates are swapped in as they are renewed without restarting the server. When the manager is
+// unable to provide a certificate (e.g. for a wildcard site), the certificate of the fallback is served instead.
+func TLSConfig(manager *autocert.Manager, fallback *tls.Config) *tls.Config {
+	config := manager.TLSConfig()
+	config.MinVersion = tls.VersionTLS12
+
+	if fallback == nil || fallback.GetCertificate == nil {
+		return config
+	}
+
+	config.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		cert, err := manager.GetCertificate(hello)
+		if err == nil {
+			return cert, nil
+		}
+
+		if alternative, fallbackErr := fallback.GetCertificate(hello); fallbackErr == nil && alternative != nil {
+			return alternative, nil
+		}
+
+		return nil, err
+	}
+
+	return config
+}
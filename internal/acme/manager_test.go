@@ -0,0 +1,191 @@
+// Copyright (C) 2022  The pages authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package acme_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mjpitz/myago/livetls"
+	"golang.org/x/crypto/acme/autocert"
+
+	"code.pitz.tech/mya/pages/internal/acme"
+)
+
+func TestNew(t *testing.T) {
+	testCases := []struct {
+		name    string
+		config  acme.Config
+		manager bool
+		err     bool
+	}{
+		{name: "disabled", config: acme.Config{Domains: []string{"example.com"}}},
+		{name: "no domains", config: acme.Config{Enable: true}, err: true},
+		{name: "missing ca file", config: acme.Config{Enable: true, Domains: []string{"example.com"}, CAFile: filepath.Join(t.TempDir(), "ca.crt")}, err: true},
+		{name: "enabled", config: acme.Config{Enable: true, Domains: []string{"example.com"}}, manager: true},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			testCase.config.Storage = t.TempDir()
+
+			manager, err := acme.New(testCase.config)
+			if (err != nil) != testCase.err {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if (manager != nil) != testCase.manager {
+				t.Fatalf("expected manager to be created: %t", testCase.manager)
+			}
+		})
+	}
+}
+
+func TestHostPolicy(t *testing.T) {
+	manager, err := acme.New(acme.Config{
+		Enable:  true,
+		Storage: t.TempDir(),
+		Domains: []string{"example.com", "www.example.com"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		host    string
+		allowed bool
+	}{
+		{host: "example.com", allowed: true},
+		{host: "www.example.com", allowed: true},
+		{host: "blog.example.com"},
+		{host: "example.org"},
+		{host: ""},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.host, func(t *testing.T) {
+			err := manager.HostPolicy(context.Background(), testCase.host)
+			if allowed := err == nil; allowed != testCase.allowed {
+				t.Fatalf("expected allowed to be %t, got %t (%v)", testCase.allowed, allowed, err)
+			}
+		})
+	}
+}
+
+func TestTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	writeCertificate(t, dir, "localhost")
+
+	fallback, err := livetls.New(context.Background(), livetls.Config{
+		Enable:         true,
+		CertPath:       dir,
+		CertFile:       "tls.crt",
+		KeyFile:        "tls.key",
+		ReloadInterval: time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	manager, err := acme.New(acme.Config{
+		Enable:  true,
+		Storage: t.TempDir(),
+		Domains: []string{"example.com"},
+	}, acme.Cache(autocert.DirCache(t.TempDir())))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := acme.TLSConfig(manager, fallback)
+	if config.MinVersion != tls.VersionTLS12 {
+		t.Fatalf("expected a minimum version of TLS 1.2, got %x", config.MinVersion)
+	}
+
+	// hosts rejected by the policy are never requested from the directory, so no network access is required here
+	for _, serverName := range []string{"localhost", "unknown.example.org", ""} {
+		cert, err := config.GetCertificate(&tls.ClientHelloInfo{ServerName: serverName})
+		if err != nil {
+			t.Fatalf("expected fallback certificate for %q: %v", serverName, err)
+		}
+
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if leaf.Subject.CommonName != "localhost" {
+			t.Fatalf("expected fallback certificate for %q, got %s", serverName, leaf.Subject.CommonName)
+		}
+	}
+
+	config = acme.TLSConfig(manager, nil)
+	if _, err := config.GetCertificate(&tls.ClientHelloInfo{ServerName: "unknown.example.org"}); err == nil {
+		t.Fatal("expected an error without a fallback certificate")
+	}
+}
+
+// writeCertificate writes a self-signed tls.crt and tls.key for the provided host to dir.
+func writeCertificate(t *testing.T, dir, host string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+
+	if err := os.WriteFile(filepath.Join(dir, "tls.crt"), certPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "tls.key"), keyPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright (C) 2022  The pages authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+//go:build pebble
+
+package acme_test
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"testing"
+
+	"code.pitz.tech/mya/pages/internal/acme"
+)
+
+// TestPebble obtains a certificate from a locally running Pebble (https://github.com/letsencrypt/pebble) instance. It
+// is only built with the pebble tag and expects Pebble to accept every challenge without contacting this host:
+//
+//	PEBBLE_VA_ALWAYS_VALID=1 pebble -config ./test/config/pebble-config.json
+//	PEBBLE_CA_FILE=./test/certs/pebble.minica.pem make test/pebble
+//
+// PEBBLE_DIRECTORY_URL overrides the default directory of https://localhost:14000/dir.
+func TestPebble(t *testing.T) {
+	caFile := os.Getenv("PEBBLE_CA_FILE")
+	if caFile == "" {
+		t.Fatal("PEBBLE_CA_FILE must point to the CA used by the pebble directory")
+	}
+
+	directoryURL := os.Getenv("PEBBLE_DIRECTORY_URL")
+	if directoryURL == "" {
+		directoryURL = "https://localhost:14000/dir"
+	}
+
+	manager, err := acme.New(acme.Config{
+		Enable:       true,
+		Email:        "pages@example.com",
+		DirectoryURL: directoryURL,
+		CAFile:       caFile,
+		Storage:      t.TempDir(),
+		Domains:      []string{"pages.example.com"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := acme.TLSConfig(manager, nil)
+
+	cert, err := config.GetCertificate(&tls.ClientHelloInfo{ServerName: "pages.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := leaf.VerifyHostname("pages.example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the certificate is now served from storage rather than requested again
+	cached, err := config.GetCertificate(&tls.ClientHelloInfo{ServerName: "pages.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(cached.Certificate[0]) != string(cert.Certificate[0]) {
+		t.Fatal("expected the stored certificate to be reused")
+	}
+
+	if _, err := config.GetCertificate(&tls.ClientHelloInfo{ServerName: "other.example.com"}); err == nil {
+		t.Fatal("expected certificates for other hosts to be refused")
+	}
+}
@@ -36,8 +36,10 @@ import (
 
 type HostConfig struct {
 	internal.ServerConfig
-	Git      git.Config `json:"git"`
-	SiteFile string     `json:"site_file" usage:"configure multiple sites using a single file"`
+	Git            git.Config      `json:"git"`
+	Cache          git.CacheConfig `json:"cache"`
+	TrustedProxies string          `json:"trusted_proxies" usage:"comma separated list of the CIDRs of reverse proxies whose X-Forwarded-Host and X-Forwarded-Proto headers are honoured"`
+	SiteFile       string          `json:"site_file"       usage:"configure multiple sites using a single file"`
 }
 
 var (
@@ -64,11 +66,6 @@ var (
 			_ = mime.AddExtensionType(".yml", "application/yaml")
 			_ = mime.AddExtensionType(".json", "application/json")
 
-			server, err := internal.NewServer(ctx.Context, hostConfig.ServerConfig)
-			if err != nil {
-				return err
-			}
-
 			endpointConfig := git.EndpointConfig{
 				Sites: make(map[string]*git.Config),
 			}
@@ -76,12 +73,23 @@ var (
 			if hostConfig.SiteFile == "" {
 				endpointConfig.Sites["*"] = &hostConfig.Git
 			} else {
-				err = config.Load(ctx.Context, &endpointConfig, hostConfig.SiteFile)
+				err := config.Load(ctx.Context, &endpointConfig, hostConfig.SiteFile)
 				if err != nil {
 					return err
 				}
 			}
 
+			hostConfig.ACME.Domains = endpointConfig.Domains()
+
+			server, err := internal.NewServer(ctx.Context, hostConfig.ServerConfig)
+			if err != nil {
+				return err
+			}
+
+			endpointConfig.TLS = hostConfig.PublicTLS()
+			endpointConfig.Cache = hostConfig.Cache
+			endpointConfig.TrustedProxies = hostConfig.TrustedProxies
+
 			endpoint, err := git.NewEndpoint(ctx.Context, endpointConfig)
 			if err != nil {
 				return err
@@ -90,12 +98,19 @@ var (
 
 			{ // git endpoints
 				server.AdminMux.HandleFunc("/sync", endpoint.Sync).Methods(http.MethodPost)
+				server.AdminMux.HandleFunc("/sites", endpoint.Sites).Methods(http.MethodGet)
+				server.AdminMux.HandleFunc("/commits", endpoint.Commits).Methods(http.MethodGet)
+				server.AdminMux.HandleFunc("/pin", endpoint.Pin).Methods(http.MethodPost)
+				server.AdminMux.HandleFunc("/pin", endpoint.Unpin).Methods(http.MethodDelete)
+				server.PublicMux.HandleFunc(hostConfig.Webhook.Prefix, endpoint.Webhook).Methods(http.MethodPost)
 				server.PublicMux.PathPrefix("/").HandlerFunc(endpoint.Lookup).Methods(http.MethodGet)
 			}
 
 			log.Info("serving",
 				zap.String("public", hostConfig.Public.Address),
-				zap.String("private", hostConfig.Private.Address))
+				zap.String("private", hostConfig.Private.Address),
+				zap.String("http", hostConfig.HTTP.Address),
+				zap.Bool("acme", hostConfig.ACME.Enable))
 
 			group, c := errgroup.WithContext(ctx.Context)
 			group.Go(server.ListenAndServe)
@@ -0,0 +1,23 @@
+// Copyright (C) 2022  The pages authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package compress
+
+// Config encapsulates configuration for compressing responses.
+type Config struct {
+	Enable  bool `json:"enable"   usage:"compress responses using gzip or brotli when supported by the client" default:"true"`
+	MinSize int  `json:"min_size" usage:"the minimum size of a response, in bytes, before it is compressed" default:"1024"`
+}
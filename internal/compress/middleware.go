@@ -0,0 +1,367 @@
+// Copyright (C) 2022  The pages authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package compress
+
+import (
+	"bufio"
+	"compress/gzip"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/gorilla/mux"
+
+	"code.pitz.tech/mya/pages/internal/excludes"
+)
+
+const (
+	// Brotli is the name of the brotli content-coding.
+	Brotli = "br"
+	// Gzip is the name of the gzip content-coding.
+	Gzip = "gzip"
+)
+
+// Encodings lists the supported content-codings in order of preference.
+var Encodings = []string{Brotli, Gzip}
+
+// Extension returns the file extension used for files that have been compressed using the provided encoding.
+func Extension(encoding string) string {
+	switch encoding {
+	case Brotli:
+		return ".br"
+	case Gzip:
+		return ".gz"
+	}
+
+	return ""
+}
+
+// Accepts returns true when the client is willing to receive a response compressed with the provided encoding.
+func Accepts(r *http.Request, encoding string) bool {
+	accepted := false
+
+	for _, value := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(value, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+
+		if name != encoding && name != "*" {
+			continue
+		}
+
+		q := 1.0
+		if params = strings.TrimSpace(params); strings.HasPrefix(params, "q=") {
+			q, _ = strconv.ParseFloat(strings.TrimPrefix(params, "q="), 64)
+		}
+
+		// explicit codings take precedence over the wildcard
+		if name == encoding {
+			return q > 0
+		}
+
+		accepted = q > 0
+	}
+
+	return accepted
+}
+
+// Vary adds Accept-Encoding to the Vary header, if it is not already present.
+func Vary(header http.Header) {
+	for _, value := range header.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(name), "Accept-Encoding") {
+				return
+			}
+		}
+	}
+
+	header.Add("Vary", "Accept-Encoding")
+}
+
+// compressible returns true for the media types that benefit from compression.
+func compressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	switch {
+	case strings.HasPrefix(mediaType, "text/"),
+		strings.HasSuffix(mediaType, "+json"),
+		strings.HasSuffix(mediaType, "+xml"):
+		return true
+	}
+
+	switch mediaType {
+	case "application/javascript", "application/json", "application/xml", "application/wasm",
+		"application/yaml", "image/svg+xml", "image/x-icon", "font/ttf", "font/otf":
+		return true
+	}
+
+	return false
+}
+
+type opt struct {
+	minSize  int
+	excludes []excludes.Exclusion
+}
+
+// Option provides a way to configure elements of the Middleware.
+type Option func(*opt)
+
+// MinSize configures the minimum size of a response, in bytes, before it is compressed.
+func MinSize(size int) Option {
+	return func(o *opt) {
+		o.minSize = size
+	}
+}
+
+// Exclusions appends the provided rules to the excludes list. Any path that matches an exclusion will not be compressed.
+func Exclusions(exclusions ...excludes.Exclusion) Option {
+	return func(o *opt) {
+		o.excludes = append(o.excludes, exclusions...)
+	}
+}
+
+// Middleware produces an HTTP middleware function that compresses responses using the encoding preferred by the
+// client. Responses that are already encoded, too small, or of a type that does not compress well are left as-is.
+// Excluded paths and protocol upgrades (e.g. websockets) are passed through untouched.
+func Middleware(opts ...Option) mux.MiddlewareFunc {
+	o := opt{minSize: 1024}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	exclude := excludes.AnyExclusion(o.excludes...)
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if exclude(r.URL.Path) || r.Header.Get("Upgrade") != "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			Vary(w.Header())
+
+			encoding := ""
+			for _, candidate := range Encodings {
+				if Accepts(r, candidate) {
+					encoding = candidate
+					break
+				}
+			}
+
+			if encoding == "" || r.Method == http.MethodHead {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			cw := &writer{
+				writer:      w,
+				encoding:    encoding,
+				minSize:     o.minSize,
+				ifNoneMatch: r.Header.Get("If-None-Match"),
+				status:      http.StatusOK,
+			}
+			defer cw.Close()
+
+			next.ServeHTTP(cw, r)
+		})
+	}
+}
+
+// writer buffers the start of a response until it can decide whether the response should be compressed.
+type writer struct {
+	writer      http.ResponseWriter
+	encoding    string
+	minSize     int
+	ifNoneMatch string
+
+	status   int
+	buffer   []byte
+	decided  bool
+	hijacked bool
+	encoder  io.WriteCloser
+}
+
+func (w *writer) Header() http.Header {
+	return w.writer.Header()
+}
+
+func (w *writer) WriteHeader(statusCode int) {
+	if w.decided {
+		return
+	}
+
+	w.status = statusCode
+
+	switch {
+	case statusCode == http.StatusNotModified:
+		w.notModified()
+		w.decide(false)
+	case statusCode < http.StatusOK,
+		statusCode == http.StatusNoContent,
+		statusCode == http.StatusPartialContent:
+		w.decide(false)
+	}
+}
+
+// notModified weakens the ETag of a 304 when the client's cached copy was compressed, so that the validator matches the
+// one that was sent with the compressed response.
+func (w *writer) notModified() {
+	header := w.writer.Header()
+
+	etag := header.Get("ETag")
+	if etag == "" || strings.HasPrefix(etag, "W/") || header.Get("Content-Encoding") != "" {
+		return
+	}
+
+	for _, candidate := range strings.Split(w.ifNoneMatch, ",") {
+		if strings.TrimSpace(candidate) == "W/"+etag {
+			header.Set("ETag", "W/"+etag)
+			return
+		}
+	}
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	if !w.decided {
+		w.buffer = append(w.buffer, p...)
+		if len(w.buffer) < w.minSize {
+			return len(p), nil
+		}
+
+		w.decide(true)
+		return len(p), w.flush()
+	}
+
+	if w.encoder != nil {
+		return w.encoder.Write(p)
+	}
+
+	return w.writer.Write(p)
+}
+
+// decide determines whether the response is compressed and writes its header. Large is set when the response is known
+// to be at least minSize bytes.
+func (w *writer) decide(large bool) {
+	w.decided = true
+
+	header := w.writer.Header()
+
+	if large && header.Get("Content-Encoding") == "" {
+		contentType := header.Get("Content-Type")
+		if contentType == "" {
+			// sniff the uncompressed content, rather than letting net/http sniff the compressed content
+			contentType = http.DetectContentType(w.buffer)
+			header.Set("Content-Type", contentType)
+		}
+
+		if compressible(contentType) {
+			header.Del("Content-Length")
+			header.Set("Content-Encoding", w.encoding)
+
+			// the compressed representation is no longer byte-for-byte identical
+			if etag := header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+				header.Set("ETag", "W/"+etag)
+			}
+
+			switch w.encoding {
+			case Brotli:
+				w.encoder = brotli.NewWriter(w.writer)
+			case Gzip:
+				w.encoder = gzip.NewWriter(w.writer)
+			}
+		}
+	}
+
+	w.writer.WriteHeader(w.status)
+}
+
+func (w *writer) flush() error {
+	buffer := w.buffer
+	w.buffer = nil
+
+	if len(buffer) == 0 {
+		return nil
+	}
+
+	if w.encoder != nil {
+		_, err := w.encoder.Write(buffer)
+		return err
+	}
+
+	_, err := w.writer.Write(buffer)
+	return err
+}
+
+// Flush sends any buffered content to the client. Responses that are flushed before reaching minSize are not
+// compressed, since the remainder of the response is being streamed.
+func (w *writer) Flush() {
+	if !w.decided {
+		w.decide(false)
+	}
+
+	_ = w.flush()
+
+	if flusher, ok := w.encoder.(interface{ Flush() error }); ok {
+		_ = flusher.Flush()
+	}
+
+	if flusher, ok := w.writer.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack hands the underlying connection over to the caller, after which the writer no longer writes anything.
+func (w *writer) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.writer.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+
+	conn, rw, err := hijacker.Hijack()
+	if err == nil {
+		w.hijacked = true
+	}
+
+	return conn, rw, err
+}
+
+// Close writes any buffered content and finishes the compressed stream.
+func (w *writer) Close() error {
+	if w.hijacked {
+		return nil
+	}
+
+	if !w.decided {
+		w.decide(false)
+	}
+
+	err := w.flush()
+
+	if w.encoder != nil {
+		if closeErr := w.encoder.Close(); err == nil {
+			err = closeErr
+		}
+	}
+
+	return err
+}
@@ -17,31 +17,135 @@
 package git
 
 import (
+	"bytes"
+	"io"
 	"io/fs"
 	"net/http"
 	"os"
+	"path"
+	"strings"
 	"sync"
 
 	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/util"
+	"github.com/go-git/go-git/v5/plumbing"
 )
 
-// HTTP translates a billy.Filesystem into an http.FileSystem that can be used with the http.FileServer.
-func HTTP(fs billy.Filesystem) http.FileSystem {
-	return http.FS(&httpFS{fs: fs})
+// HTTPOption provides a way to configure elements of the http.FileSystem returned by HTTP.
+type HTTPOption func(*httpFS)
+
+// ServeHidden configures whether hidden files and directories (those beginning with a dot) can be served.
+func ServeHidden(serve bool) HTTPOption {
+	return func(f *httpFS) {
+		f.serveHidden = serve
+	}
+}
+
+// AllowHidden permits the provided hidden paths (and everything beneath them) to be served, even when hidden files are
+// otherwise denied.
+func AllowHidden(paths ...string) HTTPOption {
+	return func(f *httpFS) {
+		for _, p := range paths {
+			p = strings.Trim(path.Clean("/"+p), "/")
+			if p != "" {
+				f.allowHidden[p] = true
+			}
+		}
+	}
+}
+
+// Metadata reports the blob hash and last commit time of the provided files, keyed by their path, instead of the
+// information found on disk.
+func Metadata(files map[string]fileMeta) HTTPOption {
+	return func(f *httpFS) {
+		f.files = files
+	}
+}
+
+// Cached serves the files of the provided site and commit from memory whenever possible.
+func Cached(cache *contentCache, domain string, commit plumbing.Hash) HTTPOption {
+	return func(f *httpFS) {
+		f.cache = cache
+		f.domain = domain
+		f.commit = commit
+	}
+}
+
+// HTTP translates a billy.Filesystem into an http.FileSystem that can be used with the http.FileServer. By default,
+// hidden files and directories are not served.
+func HTTP(fs billy.Filesystem, opts ...HTTPOption) http.FileSystem {
+	f := &httpFS{
+		fs:          fs,
+		allowHidden: make(map[string]bool),
+	}
+
+	for _, opt := range opts {
+		opt(f)
+	}
+
+	return http.FS(f)
 }
 
 type httpFS struct {
-	fs billy.Filesystem
+	fs          billy.Filesystem
+	serveHidden bool
+	allowHidden map[string]bool
+	files       map[string]fileMeta
+
+	cache  *contentCache
+	domain string
+	commit plumbing.Hash
+}
+
+// visible determines if the named file can be served. Any hidden element in the path must be explicitly allowed.
+func (f *httpFS) visible(name string) bool {
+	if f.serveHidden {
+		return true
+	}
+
+	parts := strings.Split(name, "/")
+	for i, part := range parts {
+		if strings.HasPrefix(part, ".") && part != "." && !f.allowHidden[strings.Join(parts[:i+1], "/")] {
+			return false
+		}
+	}
+
+	return true
 }
 
 func (f *httpFS) Open(name string) (fs.File, error) {
+	if !f.visible(name) {
+		// report hidden files as missing to avoid revealing their existence
+		return nil, fs.ErrNotExist
+	}
+
+	key := cacheKey{domain: f.domain, commit: f.commit, name: name}
+	if item, ok := f.cache.get(key); ok {
+		return &cachedFile{Reader: bytes.NewReader(item.data), info: item.info}, nil
+	}
+
 	fileInfo, err := f.fs.Stat(name)
 	if err != nil {
 		return nil, err
 	}
 
+	if meta, ok := f.files[name]; ok && !fileInfo.IsDir() {
+		fileInfo = &metaFileInfo{FileInfo: fileInfo, meta: meta}
+	}
+
+	if fileInfo.Mode().IsRegular() && f.cache.fits(f.domain, fileInfo.Size()) {
+		data, err := util.ReadFile(f.fs, name)
+		if err != nil {
+			return nil, err
+		}
+
+		f.cache.put(key, data, fileInfo)
+		return &cachedFile{Reader: bytes.NewReader(data), info: fileInfo}, nil
+	}
+
 	return &httpFile{
 		once:     sync.Once{},
+		httpFS:   f,
 		fs:       f.fs,
 		name:     name,
 		fileInfo: fileInfo,
@@ -51,14 +155,24 @@ func (f *httpFS) Open(name string) (fs.File, error) {
 type httpFile struct {
 	once sync.Once
 
-	fs   billy.Filesystem
-	name string
+	httpFS *httpFS
+	fs     billy.Filesystem
+	name   string
 
 	fileInfo os.FileInfo
 	file     billy.File
+	err      error
+
+	entries []fs.DirEntry
+	offset  int
 }
 
 func (f *httpFile) Seek(offset int64, whence int) (int64, error) {
+	f.once.Do(f.init)
+	if f.err != nil {
+		return 0, f.err
+	}
+
 	return f.file.Seek(offset, whence)
 }
 
@@ -67,14 +181,57 @@ func (f *httpFile) Stat() (fs.FileInfo, error) {
 }
 
 func (f *httpFile) init() {
-	f.file, _ = f.fs.Open(f.name)
+	f.file, f.err = f.fs.Open(f.name)
 }
 
 func (f *httpFile) Read(bytes []byte) (int, error) {
 	f.once.Do(f.init)
+	if f.err != nil {
+		return 0, f.err
+	}
+
 	return f.file.Read(bytes)
 }
 
+// ReadDir lists the visible contents of the directory, following the semantics of fs.ReadDirFile.
+func (f *httpFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	if f.entries == nil {
+		infos, err := f.fs.ReadDir(f.name)
+		if err != nil {
+			return nil, err
+		}
+
+		f.entries = make([]fs.DirEntry, 0, len(infos))
+		for _, info := range infos {
+			name := path.Join(f.name, info.Name())
+			if !f.httpFS.visible(name) {
+				continue
+			}
+
+			if meta, ok := f.httpFS.files[name]; ok && !info.IsDir() {
+				info = &metaFileInfo{FileInfo: info, meta: meta}
+			}
+
+			f.entries = append(f.entries, fs.FileInfoToDirEntry(info))
+		}
+	}
+
+	remaining := f.entries[f.offset:]
+
+	switch {
+	case n <= 0:
+		f.offset = len(f.entries)
+		return remaining, nil
+	case len(remaining) == 0:
+		return nil, io.EOF
+	case n < len(remaining):
+		remaining = remaining[:n]
+	}
+
+	f.offset += len(remaining)
+	return remaining, nil
+}
+
 func (f *httpFile) Close() error {
 	if f.file != nil {
 		return f.file.Close()
@@ -0,0 +1,265 @@
+// Copyright (C) 2022  The pages authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package git
+
+import (
+	"bytes"
+	"container/list"
+	"io/fs"
+	"sync"
+
+	"github.com/go-git/go-git/v5/plumbing"
+
+	"code.pitz.tech/mya/pages/internal/metrics"
+)
+
+const megabyte = 1 << 20
+
+// CacheConfig encapsulates the elements that can be configured about the in-memory cache of file contents that is
+// shared by all sites.
+type CacheConfig struct {
+	Size int `json:"size" usage:"maximum number of megabytes of file contents kept in memory across all sites, 0 disables the cache" default:"64"`
+}
+
+// cacheKey identifies the contents of a file at a given commit of a site.
+type cacheKey struct {
+	domain string
+	commit plumbing.Hash
+	name   string
+}
+
+type cacheItem struct {
+	key  cacheKey
+	data []byte
+	info fs.FileInfo
+
+	global *list.Element
+	local  *list.Element
+}
+
+// siteCache tracks the portion of the cache used by a single site.
+type siteCache struct {
+	limit int64
+	size  int64
+	lru   *list.List
+}
+
+// contentCache is a bounded, least recently used cache of file contents. The cache is bounded globally and, optionally,
+// per site. A nil contentCache caches nothing.
+type contentCache struct {
+	mu    sync.Mutex
+	limit int64
+	size  int64
+	lru   *list.List
+	items map[cacheKey]*cacheItem
+	sites map[string]*siteCache
+}
+
+// newContentCache returns a cache that holds up to the provided number of megabytes. The cache is disabled when the
+// size is not positive.
+func newContentCache(cfg CacheConfig) *contentCache {
+	if cfg.Size <= 0 {
+		return nil
+	}
+
+	return &contentCache{
+		limit: int64(cfg.Size) * megabyte,
+		lru:   list.New(),
+		items: make(map[cacheKey]*cacheItem),
+		sites: make(map[string]*siteCache),
+	}
+}
+
+// register limits the site to the provided number of megabytes. Sites with a size of 0 are only bound by the global
+// limit.
+func (c *contentCache) register(domain string, size int) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.site(domain).limit = int64(size) * megabyte
+}
+
+func (c *contentCache) site(domain string) *siteCache {
+	site := c.sites[domain]
+	if site == nil {
+		site = &siteCache{lru: list.New()}
+		c.sites[domain] = site
+	}
+
+	return site
+}
+
+// fits returns true when a file of the provided size is small enough to be cached for the site. Files may use at most
+// an eighth of the cache to avoid a single large file flushing everything else.
+func (c *contentCache) fits(domain string, size int64) bool {
+	if c == nil {
+		return false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	limit := c.limit
+	if site := c.sites[domain]; site != nil && site.limit > 0 && site.limit < limit {
+		limit = site.limit
+	}
+
+	return size <= limit/8
+}
+
+func (c *contentCache) get(key cacheKey) (*cacheItem, bool) {
+	if c == nil {
+		return nil, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	item, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+
+	c.lru.MoveToFront(item.global)
+	c.sites[key.domain].lru.MoveToFront(item.local)
+
+	metrics.CacheHits.WithLabelValues(key.domain).Inc()
+	return item, true
+}
+
+// put adds the contents of a file that was read from disk to the cache, evicting the least recently used files of the
+// site, and then of all sites, until the cache is within its limits.
+func (c *contentCache) put(key cacheKey, data []byte, info fs.FileInfo) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	metrics.CacheMisses.WithLabelValues(key.domain).Inc()
+
+	if _, ok := c.items[key]; ok {
+		return
+	}
+
+	site := c.site(key.domain)
+	item := &cacheItem{key: key, data: data, info: info}
+	item.global = c.lru.PushFront(item)
+	item.local = site.lru.PushFront(item)
+
+	c.items[key] = item
+	c.size += int64(len(data))
+	site.size += int64(len(data))
+	metrics.CacheBytes.WithLabelValues(key.domain).Set(float64(site.size))
+
+	for site.limit > 0 && site.size > site.limit {
+		c.evict(site.lru.Back().Value.(*cacheItem))
+	}
+
+	for c.size > c.limit {
+		c.evict(c.lru.Back().Value.(*cacheItem))
+	}
+}
+
+func (c *contentCache) evict(item *cacheItem) {
+	c.remove(item)
+	metrics.CacheEvictions.WithLabelValues(item.key.domain).Inc()
+}
+
+func (c *contentCache) remove(item *cacheItem) {
+	site := c.sites[item.key.domain]
+
+	c.lru.Remove(item.global)
+	site.lru.Remove(item.local)
+	delete(c.items, item.key)
+
+	c.size -= int64(len(item.data))
+	site.size -= int64(len(item.data))
+	metrics.CacheBytes.WithLabelValues(item.key.domain).Set(float64(site.size))
+}
+
+// purge removes the files of the site that do not belong to the provided commit.
+func (c *contentCache) purge(domain string, commit plumbing.Hash) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	site := c.sites[domain]
+	if site == nil {
+		return
+	}
+
+	for element := site.lru.Front(); element != nil; {
+		item := element.Value.(*cacheItem)
+		element = element.Next()
+
+		if item.key.commit != commit {
+			c.remove(item)
+		}
+	}
+}
+
+// forget removes all files of the site from the cache and stops reporting metrics for it.
+func (c *contentCache) forget(domain string) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	site := c.sites[domain]
+	if site == nil {
+		return
+	}
+
+	for element := site.lru.Front(); element != nil; {
+		item := element.Value.(*cacheItem)
+		element = element.Next()
+
+		c.remove(item)
+	}
+
+	delete(c.sites, domain)
+
+	metrics.CacheHits.DeleteLabelValues(domain)
+	metrics.CacheMisses.DeleteLabelValues(domain)
+	metrics.CacheEvictions.DeleteLabelValues(domain)
+	metrics.CacheBytes.DeleteLabelValues(domain)
+}
+
+// cachedFile serves the contents of a file from memory.
+type cachedFile struct {
+	*bytes.Reader
+	info fs.FileInfo
+}
+
+func (f *cachedFile) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *cachedFile) Close() error {
+	return nil
+}
@@ -0,0 +1,132 @@
+// Copyright (C) 2022  The pages authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package git
+
+import (
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultFingerprint = `[.-][0-9a-f]{8,}\.[^.]+$`
+	defaultMaxAge      = time.Hour
+	immutableMaxAge    = 365 * 24 * time.Hour
+)
+
+// CacheControlConfig encapsulates the policy used to produce the Cache-Control header of files served for a site.
+// Rules are evaluated in order and the first match wins. Files that match no rule are cached indefinitely when their
+// name is fingerprinted, revalidated when they are HTML, and otherwise cached for max_age.
+type CacheControlConfig struct {
+	Fingerprint string        `json:"fingerprint" usage:"regular expression matching the names of fingerprinted assets, which are cached indefinitely" default:"[.-][0-9a-f]{8,}\\.[^.]+$"`
+	MaxAge      time.Duration `json:"max_age"     usage:"how long assets that are neither fingerprinted nor html can be cached" default:"1h"`
+	Rules       []CacheRule   `json:"rules"`
+}
+
+// CacheRule sets the Cache-Control header of the files it matches. Matches beginning with a '.' compare the file
+// extension (e.g. .css), matches containing a '/' are glob patterns compared against the full path (e.g. /assets/*),
+// and all other matches are glob patterns compared against the name of the file (e.g. *.woff2).
+type CacheRule struct {
+	Match     string        `json:"match"`
+	MaxAge    time.Duration `json:"max_age"`
+	Immutable bool          `json:"immutable"`
+	NoCache   bool          `json:"no_cache"`
+}
+
+func (r CacheRule) matches(name string) bool {
+	switch {
+	case strings.HasPrefix(r.Match, "."):
+		return path.Ext(name) == r.Match
+	case strings.Contains(r.Match, "/"):
+		ok, _ := path.Match(r.Match, name)
+		return ok
+	default:
+		ok, _ := path.Match(r.Match, path.Base(name))
+		return ok
+	}
+}
+
+func (r CacheRule) header() string {
+	if r.NoCache {
+		return "no-cache"
+	}
+
+	header := "public, max-age=" + strconv.Itoa(int(r.MaxAge.Seconds()))
+	if r.Immutable {
+		header += ", immutable"
+	}
+
+	return header
+}
+
+// cacheControl is the compiled form of a CacheControlConfig.
+type cacheControl struct {
+	fingerprint *regexp.Regexp
+	maxAge      time.Duration
+	rules       []CacheRule
+}
+
+func parseCacheControl(cfg CacheControlConfig) (*cacheControl, error) {
+	fingerprint := cfg.Fingerprint
+	if fingerprint == "" {
+		fingerprint = defaultFingerprint
+	}
+
+	exp, err := regexp.Compile(fingerprint)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse fingerprint pattern")
+	}
+
+	for _, rule := range cfg.Rules {
+		if _, err := path.Match(rule.Match, ""); err != nil {
+			return nil, errors.Wrapf(err, "failed to parse cache rule %s", rule.Match)
+		}
+	}
+
+	maxAge := cfg.MaxAge
+	if maxAge <= 0 {
+		maxAge = defaultMaxAge
+	}
+
+	return &cacheControl{
+		fingerprint: exp,
+		maxAge:      maxAge,
+		rules:       cfg.Rules,
+	}, nil
+}
+
+// header returns the Cache-Control header for the file at the provided path.
+func (c *cacheControl) header(name string) string {
+	for _, rule := range c.rules {
+		if rule.matches(name) {
+			return rule.header()
+		}
+	}
+
+	switch ext := path.Ext(name); {
+	case c.fingerprint.MatchString(path.Base(name)):
+		return CacheRule{MaxAge: immutableMaxAge, Immutable: true}.header()
+	case ext == ".html" || ext == ".htm":
+		return CacheRule{NoCache: true}.header()
+	default:
+		return CacheRule{MaxAge: c.maxAge}.header()
+	}
+}
@@ -2,54 +2,122 @@ package git
 
 import (
 	"context"
+	"encoding/json"
 	"net/http"
-	"net/url"
 	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/go-git/go-git/v5/plumbing"
 	"github.com/jonboulle/clockwork"
+	"github.com/pkg/errors"
 	"go.uber.org/zap"
 	"golang.org/x/sync/errgroup"
 
+	"code.pitz.tech/mya/pages/internal/metrics"
+	"code.pitz.tech/mya/pages/internal/web"
+
 	"github.com/mjpitz/myago/clocks"
 	"github.com/mjpitz/myago/zaputil"
 )
 
 type EndpointConfig struct {
 	Sites map[string]*Config `json:"sites"`
+
+	// TLS indicates that the server is able to accept HTTPS requests. Sites are only redirected to HTTPS when it is set.
+	TLS bool `json:"-"`
+
+	// Cache configures the in-memory cache of file contents shared by all sites.
+	Cache CacheConfig `json:"-"`
+
+	// TrustedProxies is a comma separated list of the CIDRs of reverse proxies whose X-Forwarded-Host and
+	// X-Forwarded-Proto headers are honoured.
+	TrustedProxies string `json:"-"`
 }
 
 func NewEndpoint(ctx context.Context, multi EndpointConfig) (endpoint *Endpoint, err error) {
 	clock := clocks.Extract(ctx)
 	log := zaputil.Extract(ctx)
 
+	proxies, err := parseTrustedProxies(multi.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+
 	endpoint = &Endpoint{
-		sites: make(map[string]*entry),
+		sites:    make(map[string]*entry),
+		router:   router{hosts: make(map[string]*entry)},
+		tls:      multi.TLS,
+		proxies:  proxies,
+		cache:    newContentCache(multi.Cache),
+		ctx:      ctx,
+		previews: make(map[string]*preview),
 	}
 
 	for domain, cfg := range multi.Sites {
 		log.Info("loading site",
 			zap.String("domain", domain),
 			zap.String("tag", cfg.Tag),
+			zap.String("tag_constraint", cfg.TagConstraint),
 			zap.String("branch", cfg.Branch),
+			zap.String("root", cfg.Root),
+			zap.Strings("aliases", cfg.Aliases),
 			zap.Duration("sync_interval", cfg.SyncInterval),
 		)
 
+		cacheControl, err := parseCacheControl(cfg.CacheControl)
+		if err != nil {
+			return nil, err
+		}
+
 		endpoint.sites[domain] = &entry{
-			config: *cfg,
+			domain:       domain,
+			config:       *cfg,
+			cacheControl: cacheControl,
+			cache:        endpoint.cache,
 		}
 
+		endpoint.cache.register(domain, cfg.CacheSize)
+
 		endpoint.sites[domain].service, err = NewService(*cfg)
 		if err != nil {
 			return nil, err
 		}
 
+		endpoint.sites[domain].service.observe = observeSync(domain)
+
 		err = endpoint.sites[domain].service.Load(ctx)
 		if err != nil {
 			return nil, err
 		}
+
+		endpoint.sites[domain].report()
+
+		for _, host := range append([]string{domain}, cfg.Aliases...) {
+			err = endpoint.router.addSite(host, endpoint.sites[domain])
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if cfg.Preview.Pattern != "" {
+			pattern, err := parsePreviewPattern(cfg.Preview.Pattern)
+			if err != nil {
+				return nil, err
+			}
+
+			endpoint.router.addPreview(&previewSite{
+				pattern: pattern,
+				config:  *cfg,
+			})
+		}
 	}
 
+	endpoint.router.sort()
+
 	for domain, cfg := range multi.Sites {
 		endpoint.sites[domain].ticker = clock.NewTicker(cfg.SyncInterval)
 	}
@@ -58,37 +126,312 @@ func NewEndpoint(ctx context.Context, multi EndpointConfig) (endpoint *Endpoint,
 }
 
 type entry struct {
-	config  Config
-	service *Service
-	ticker  clockwork.Ticker
+	domain       string
+	config       Config
+	cacheControl *cacheControl
+	cache        *contentCache
+	service      *Service
+	ticker       clockwork.Ticker
+
+	mu       sync.Mutex
+	tag      string
+	commit   string
+	accessed time.Time
+}
+
+// touch records that the entry was accessed at the provided time.
+func (e *entry) touch(now time.Time) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.accessed = now
+}
+
+func (e *entry) lastAccess() time.Time {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.accessed
+}
+
+// close stops synchronizing the entry, removes its files from disk, and stops reporting metrics for it.
+func (e *entry) close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.ticker.Stop()
+
+	metrics.SiteTag.DeleteLabelValues(e.domain, e.tag)
+	metrics.SiteCommit.DeleteLabelValues(e.domain, e.commit)
+	metrics.SiteLastSyncAttempt.DeleteLabelValues(e.domain)
+	metrics.SiteLastSyncSuccess.DeleteLabelValues(e.domain)
+	metrics.SiteSyncFailures.DeleteLabelValues(e.domain)
+	metrics.SiteSyncDuration.DeleteLabelValues(e.domain)
+
+	e.cache.forget(e.domain)
+
+	return e.service.Close()
+}
+
+// sync synchronizes the underlying service and reports the resulting state.
+func (e *entry) sync(ctx context.Context) error {
+	defer e.report()
+
+	return e.service.Sync(ctx)
+}
+
+// report publishes metrics about the current state of the site. Cached files of commits that are no longer being served
+// are dropped as well.
+func (e *entry) report() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	tag := e.service.Tag()
+	if tag != e.tag && e.tag != "" {
+		metrics.SiteTag.DeleteLabelValues(e.domain, e.tag)
+	}
+
+	e.tag = tag
+	if tag != "" {
+		metrics.SiteTag.WithLabelValues(e.domain, tag).Set(1)
+	}
+
+	commit := e.service.Commit()
+	if commit != e.commit && e.commit != "" {
+		metrics.SiteCommit.DeleteLabelValues(e.domain, e.commit)
+
+		// the files of the previous commit will no longer be served
+		e.cache.purge(e.domain, plumbing.NewHash(commit))
+	}
+
+	e.commit = commit
+	if commit != "" {
+		metrics.SiteCommit.WithLabelValues(e.domain, commit).Set(1)
+	}
+
+	state := e.service.State()
+
+	metrics.SiteLastSyncAttempt.WithLabelValues(e.domain).Set(float64(state.LastAttempt.Unix()))
+	metrics.SiteSyncFailures.WithLabelValues(e.domain).Set(float64(state.Failures))
+
+	if !state.LastSuccess.IsZero() {
+		metrics.SiteLastSyncSuccess.WithLabelValues(e.domain).Set(float64(state.LastSuccess.Unix()))
+	}
+}
+
+// observeSync returns a function that records the duration of attempts to synchronize the site.
+func observeSync(domain string) func(time.Duration) {
+	return func(duration time.Duration) {
+		metrics.SiteSyncDuration.WithLabelValues(domain).Observe(duration.Seconds())
+	}
+}
+
+// Status describes the current state of a site.
+type Status struct {
+	Domain    string    `json:"domain"`
+	Config    Config    `json:"config"`
+	Reference string    `json:"reference"`
+	Tag       string    `json:"tag,omitempty"`
+	Commit    string    `json:"commit"`
+	Pinned    bool      `json:"pinned"`
+	Sync      SyncState `json:"sync"`
+}
+
+func (e *entry) status() Status {
+	return Status{
+		Domain:    e.domain,
+		Config:    e.config.Redacted(),
+		Reference: e.service.Upstream().String(),
+		Tag:       e.service.Tag(),
+		Commit:    e.service.Commit(),
+		Pinned:    e.service.Pinned(),
+		Sync:      e.service.State(),
+	}
 }
 
 type Endpoint struct {
-	sites map[string]*entry
+	sites   map[string]*entry
+	router  router
+	tls     bool
+	proxies trustedProxies
+	cache   *contentCache
+
+	// ctx outlives individual requests and is used to load previews
+	ctx context.Context
+
+	mu       sync.Mutex
+	previews map[string]*preview
+}
+
+// entries returns all sites and loaded previews.
+func (e *Endpoint) entries() []*entry {
+	entries := make([]*entry, 0, len(e.sites))
+	for _, entry := range e.sites {
+		entries = append(entries, entry)
+	}
+
+	return append(entries, e.loadedPreviews()...)
 }
 
 func (e *Endpoint) lookupSite(r *http.Request) *entry {
-	if len(e.sites) == 1 && e.sites["*"] != nil {
-		return e.sites["*"]
+	host := e.proxies.requestHost(r)
+
+	if entry := e.router.hosts[host]; entry != nil {
+		return entry
 	}
 
-	url, err := url.Parse(r.RequestURI)
+	for _, route := range e.router.routes {
+		if route.preview == nil {
+			if strings.HasSuffix(host, route.suffix) {
+				return route.entry
+			}
+
+			continue
+		}
+
+		if label, ok := route.preview.pattern.Branch(host); ok {
+			return e.lookupPreview(r.Context(), host, label, route.preview)
+		}
+	}
+
+	return e.router.fallback
+}
+
+func (e *Endpoint) Sync(w http.ResponseWriter, r *http.Request) {
+	entry := e.lookupSite(r)
+
+	if entry == nil {
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+
+	err := entry.sync(r.Context())
 	if err != nil {
-		return nil
+		syncError(w, err)
+		return
 	}
+}
 
-	domain := url.Hostname()
-	switch {
-	case r.Header.Get("Host") != "":
-		domain = r.Header.Get("Host")
-	case r.Header.Get("X-Forwarded-Host") != "":
-		domain = r.Header.Get("X-Forwarded-Host")
+// syncErrors maps the reasons a sync may fail to the HTTP status reported to callers.
+var syncErrors = []struct {
+	reason error
+	name   string
+	status int
+}{
+	{ErrAuthentication, "authentication", http.StatusForbidden},
+	{ErrReferenceNotFound, "reference_not_found", http.StatusNotFound},
+	{ErrConflict, "conflict", http.StatusConflict},
+	{ErrNetwork, "network", http.StatusBadGateway},
+}
+
+// syncError writes a JSON description of the provided sync failure.
+func syncError(w http.ResponseWriter, err error) {
+	body := struct {
+		Reason string `json:"reason"`
+		Error  string `json:"error"`
+	}{
+		Reason: "unknown",
+		Error:  err.Error(),
+	}
+
+	status := http.StatusInternalServerError
+
+	for _, candidate := range syncErrors {
+		if errors.Is(err, candidate.reason) {
+			body.Reason = candidate.name
+			status = candidate.status
+			break
+		}
 	}
 
-	return e.sites[domain]
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(body)
 }
 
-func (e *Endpoint) Sync(w http.ResponseWriter, r *http.Request) {
+// Sites lists the configuration and current state of every site, including the tag being served.
+func (e *Endpoint) Sites(w http.ResponseWriter, r *http.Request) {
+	entries := e.entries()
+
+	statuses := make([]Status, 0, len(entries))
+	for _, entry := range entries {
+		statuses = append(statuses, entry.status())
+	}
+
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Domain < statuses[j].Domain
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(statuses)
+}
+
+// Commits lists the recent commits of the tracked reference for a site.
+func (e *Endpoint) Commits(w http.ResponseWriter, r *http.Request) {
+	entry := e.lookupSite(r)
+
+	if entry == nil {
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+
+	limit := 20
+	if v := r.URL.Query().Get("limit"); v != "" {
+		parsed, err := strconv.Atoi(v)
+		if err != nil || parsed <= 0 {
+			http.Error(w, "", http.StatusBadRequest)
+			return
+		}
+
+		limit = parsed
+	}
+
+	commits, err := entry.service.Commits(r.Context(), limit)
+	if err != nil {
+		syncError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(commits)
+}
+
+// PinRequest describes the commit a site should be pinned to.
+type PinRequest struct {
+	Commit string `json:"commit"`
+}
+
+// Pin checks out the requested commit for a site and suspends synchronization until the site is unpinned.
+func (e *Endpoint) Pin(w http.ResponseWriter, r *http.Request) {
+	entry := e.lookupSite(r)
+
+	if entry == nil {
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+
+	req := PinRequest{}
+
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || req.Commit == "" {
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+
+	err = entry.service.Pin(r.Context(), req.Commit)
+	entry.report()
+
+	if err != nil {
+		syncError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(entry.status())
+}
+
+// Unpin resumes synchronization for a site.
+func (e *Endpoint) Unpin(w http.ResponseWriter, r *http.Request) {
 	entry := e.lookupSite(r)
 
 	if entry == nil {
@@ -96,21 +439,97 @@ func (e *Endpoint) Sync(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err := entry.service.Sync(r.Context())
+	err := entry.service.Unpin(r.Context())
+	entry.report()
+
 	if err != nil {
-		http.Error(w, "", http.StatusInternalServerError)
+		syncError(w, err)
 		return
 	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(entry.status())
 }
 
 func (e *Endpoint) Lookup(w http.ResponseWriter, r *http.Request) {
 	entry := e.lookupSite(r)
 
 	if entry == nil {
-		http.Error(w, "", http.StatusNotFound)
+		web.Error(w, http.StatusNotFound)
 		return
 	}
 
+	// browsers ignore the header on plain HTTP responses
+	if hsts := entry.config.HSTS; hsts.MaxAge > 0 && e.proxies.requestScheme(r) == "https" {
+		w.Header().Set("Strict-Transport-Security", hsts.header())
+	}
+
+	if location, ok := canonicalURL(r, e.proxies, entry.config, e.tls); ok {
+		http.Redirect(w, r, location, http.StatusMovedPermanently)
+		return
+	}
+
+	rev := entry.service.acquire()
+	if rev == nil {
+		// the site was removed (e.g. an evicted preview) after the request was routed to it
+		web.Error(w, http.StatusServiceUnavailable)
+		return
+	}
+	defer rev.release()
+
+	files := HTTP(rev.fs, append(entry.config.Hidden.options(),
+		Metadata(rev.files),
+		Cached(e.cache, entry.domain, rev.hash),
+	)...)
+
+	if reserved(r.URL.Path) {
+		serveError(w, files, http.StatusNotFound)
+		return
+	}
+
+	for name, values := range rev.rules.header(r.URL.Path) {
+		w.Header()[name] = values
+	}
+
+	rule, target, ok := rev.rules.redirect(r.URL.Path, func() bool { return servable(files, r.URL.Path, entry.config) })
+	rewritten := false
+
+	switch {
+	case ok && rule.redirect():
+		if !strings.Contains(target, "?") && r.URL.RawQuery != "" {
+			target += "?" + r.URL.RawQuery
+		}
+
+		http.Redirect(w, r, target, rule.status)
+		return
+	case ok:
+		target, query, _ := strings.Cut(target, "?")
+
+		r = r.Clone(r.Context())
+		r.URL.Path = target
+		r.URL.RawPath = ""
+		rewritten = true
+
+		if query != "" {
+			r.URL.RawQuery = query
+		}
+
+		if rule.status != http.StatusOK {
+			w = &statusWriter{ResponseWriter: w, status: rule.status}
+		}
+	case entry.config.SPAFallback && path.Ext(r.URL.Path) == "" && acceptsHTML(r) && !servable(files, r.URL.Path, entry.config):
+		document := entry.config.SPADocument
+		if document == "" {
+			document = "index.html"
+		}
+
+		// the original request is left untouched so that the page view is recorded for the requested path
+		r = r.Clone(r.Context())
+		r.URL.Path = path.Join("/", document)
+		r.URL.RawPath = ""
+		rewritten = true
+	}
+
 	// Lookup file
 	values := r.URL.Query()
 
@@ -120,22 +539,62 @@ func (e *Endpoint) Lookup(w http.ResponseWriter, r *http.Request) {
 		index := path.Join(r.URL.Path, "index.html")
 
 		// if index.html exists, then use that
-		info, err := entry.service.FS.Stat(index)
+		file, err := files.Open(index)
 		if err == nil {
-			file, err := entry.service.FS.Open(index)
+			defer file.Close()
+
+			info, err := file.Stat()
 			if err != nil {
-				http.Error(w, "", http.StatusInternalServerError)
+				serveError(w, files, http.StatusInternalServerError)
 				return
 			}
 
-			defer file.Close()
-
 			http.ServeContent(w, r, name, info.ModTime(), file)
 			return
 		}
 	}
 
-	http.FileServer(HTTP(entry.service.FS)).ServeHTTP(w, r)
+	pages := &pageWriter{ResponseWriter: w, files: files}
+	defer pages.flush()
+
+	serveFile(pages, r, files, entry, !rewritten)
+}
+
+// acceptsHTML returns true when the client indicated that it accepts an HTML response.
+func acceptsHTML(r *http.Request) bool {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, _ := strings.Cut(accept, ";")
+		if strings.TrimSpace(mediaType) == "text/html" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// statusWriter replaces the status of successful responses, allowing a rewritten file to be served as a 404.
+type statusWriter struct {
+	http.ResponseWriter
+	status  int
+	written bool
+}
+
+func (w *statusWriter) WriteHeader(statusCode int) {
+	if w.written {
+		return
+	}
+
+	if statusCode == http.StatusOK {
+		statusCode = w.status
+	}
+
+	w.written = true
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *statusWriter) Write(p []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.ResponseWriter.Write(p)
 }
 
 func (e *Endpoint) SyncLoop(ctx context.Context) error {
@@ -144,31 +603,36 @@ func (e *Endpoint) SyncLoop(ctx context.Context) error {
 	timer := clock.NewTicker(30 * time.Second)
 	defer timer.Stop()
 
-	keys := make([]string, 0, len(e.sites))
-	for key := range e.sites {
-		keys = append(keys, key)
-	}
-
 	group := &errgroup.Group{}
 
 	for {
-		for i := 0; i < len(keys); i++ {
+		// previews come and go, so the set of entries is refreshed on every pass
+		entries := e.entries()
+
+		for i := 0; i < len(entries); i++ {
 			select {
 			case <-ctx.Done():
 				// context cancelled / hit deadline
 				return ctx.Err()
 
-			case <-e.sites[keys[i]].ticker.Chan():
-				service := e.sites[keys[i]].service
+			case <-entries[i].ticker.Chan():
+				entry := entries[i]
 
 				// ticker expired, sync the site, check the next
 				// sync happens in a background thread to avoid contention on this loop
 				group.Go(func() error {
-					return service.Sync(ctx)
+					err := entry.sync(ctx)
+					if errors.Is(err, ErrReferenceNotFound) {
+						// the branch has been removed, drop the preview (no-op for configured sites)
+						e.evict(ctx, entry.domain)
+					}
+
+					return err
 				})
 
 			case <-timer.Chan():
-				// times up, check the next
+				// times up, clean up unused previews and check the next
+				e.collect(ctx)
 				continue
 			}
 		}
@@ -178,6 +642,11 @@ func (e *Endpoint) SyncLoop(ctx context.Context) error {
 func (e *Endpoint) Close() error {
 	for _, site := range e.sites {
 		site.ticker.Stop()
+		_ = site.service.Close()
+	}
+
+	for _, preview := range e.loadedPreviews() {
+		_ = preview.close()
 	}
 
 	return nil
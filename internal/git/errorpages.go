@@ -0,0 +1,113 @@
+// Copyright (C) 2022  The pages authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package git
+
+import (
+	"io"
+	"net/http"
+)
+
+// errorPage returns the path of the page a site can provide to render responses with the provided status.
+func errorPage(status int) string {
+	switch {
+	case status == http.StatusNotFound:
+		return "/404.html"
+	case status >= http.StatusInternalServerError:
+		return "/50x.html"
+	}
+
+	return ""
+}
+
+// serveError writes the site's page for the provided status, falling back to a plain text response when the site does
+// not provide one.
+func serveError(w http.ResponseWriter, files http.FileSystem, status int) {
+	name := errorPage(status)
+	if name == "" {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+
+	file, err := files.Open(name)
+	if err != nil {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	defer file.Close()
+
+	header := w.Header()
+	header.Del("Content-Length")
+	header.Del("Content-Encoding")
+	header.Del("ETag")
+	header.Del("Last-Modified")
+	header.Set("Content-Type", "text/html; charset=utf-8")
+
+	w.WriteHeader(status)
+	_, _ = io.Copy(w, file)
+}
+
+// exists returns true when a file or directory can be opened at the provided path.
+func exists(files http.FileSystem, name string) bool {
+	file, err := files.Open(name)
+	if err != nil {
+		return false
+	}
+
+	_ = file.Close()
+	return true
+}
+
+// pageWriter holds back error responses for which the site provides its own page so that the page can be served in
+// their place once the handler returns.
+type pageWriter struct {
+	http.ResponseWriter
+	files   http.FileSystem
+	status  int
+	written bool
+}
+
+func (w *pageWriter) WriteHeader(statusCode int) {
+	if w.written || w.status != 0 {
+		return
+	}
+
+	if name := errorPage(statusCode); name != "" && exists(w.files, name) {
+		w.status = statusCode
+		return
+	}
+
+	w.written = true
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *pageWriter) Write(p []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+
+	if w.status != 0 {
+		// discard the default body of the error
+		return len(p), nil
+	}
+
+	return w.ResponseWriter.Write(p)
+}
+
+// flush serves the error page for the response that was held back, if any.
+func (w *pageWriter) flush() {
+	if w.status != 0 {
+		serveError(w.ResponseWriter, w.files, w.status)
+	}
+}
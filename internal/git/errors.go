@@ -0,0 +1,97 @@
+// Copyright (C) 2022  The pages authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package git
+
+import (
+	"context"
+	"net"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+var (
+	// ErrAuthentication is returned when the git service rejects the configured credentials or host key.
+	ErrAuthentication = errors.New("authentication failed")
+
+	// ErrReferenceNotFound is returned when the repository or the tracked branch / tag no longer exists.
+	ErrReferenceNotFound = errors.New("reference not found")
+
+	// ErrNetwork is returned when the git service could not be reached.
+	ErrNetwork = errors.New("network failure")
+
+	// ErrConflict is returned when the repository could not be updated to the requested revision.
+	ErrConflict = errors.New("conflict")
+)
+
+// SyncError associates a failure to synchronize a repository with one of the above reasons. Callers can use errors.Is
+// to test for the reason and errors.Unwrap to obtain the underlying error.
+type SyncError struct {
+	Reason error
+	Err    error
+}
+
+func (e *SyncError) Error() string {
+	return e.Reason.Error() + ": " + e.Err.Error()
+}
+
+func (e *SyncError) Unwrap() error {
+	return e.Err
+}
+
+func (e *SyncError) Is(target error) bool {
+	return target == e.Reason
+}
+
+// classify wraps the provided error in a SyncError when its reason can be determined.
+func classify(err error) error {
+	var reason error
+
+	var keyErr *knownhosts.KeyError
+	var netErr net.Error
+
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, transport.ErrAuthenticationRequired),
+		errors.Is(err, transport.ErrAuthorizationFailed),
+		errors.Is(err, transport.ErrInvalidAuthMethod),
+		errors.As(err, &keyErr),
+		strings.Contains(err.Error(), "ssh: unable to authenticate"):
+		reason = ErrAuthentication
+	case errors.Is(err, transport.ErrRepositoryNotFound),
+		errors.Is(err, transport.ErrEmptyRemoteRepository),
+		errors.Is(err, plumbing.ErrReferenceNotFound),
+		errors.Is(err, git.NoMatchingRefSpecError{}),
+		errors.Is(err, ErrNoMatchingTag):
+		reason = ErrReferenceNotFound
+	case errors.Is(err, git.ErrForceNeeded),
+		errors.Is(err, git.ErrNonFastForwardUpdate):
+		reason = ErrConflict
+	case errors.Is(err, context.DeadlineExceeded),
+		errors.As(err, &netErr):
+		reason = ErrNetwork
+	default:
+		return err
+	}
+
+	return &SyncError{Reason: reason, Err: err}
+}
@@ -0,0 +1,231 @@
+// Copyright (C) 2022  The pages authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package git
+
+import (
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// trustedProxies lists the networks of the reverse proxies whose X-Forwarded-Host and X-Forwarded-Proto headers are
+// honoured. The headers of any other client are ignored, since they would otherwise allow clients to choose the site
+// that is served or to avoid being redirected to HTTPS.
+type trustedProxies []*net.IPNet
+
+// parseTrustedProxies parses a comma separated list of CIDRs or IP addresses.
+func parseTrustedProxies(list string) (trustedProxies, error) {
+	proxies := make(trustedProxies, 0)
+
+	for _, value := range strings.Split(list, ",") {
+		value = strings.TrimSpace(value)
+
+		switch {
+		case value == "":
+			continue
+		case !strings.Contains(value, "/"):
+			ip := net.ParseIP(value)
+			if ip == nil {
+				return nil, errors.Errorf("invalid trusted proxy: %s", value)
+			}
+
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+
+			proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+		default:
+			_, network, err := net.ParseCIDR(value)
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid trusted proxy: %s", value)
+			}
+
+			proxies = append(proxies, network)
+		}
+	}
+
+	return proxies, nil
+}
+
+// trusts returns true when the request was made by one of the trusted proxies.
+func (p trustedProxies) trusts(r *http.Request) bool {
+	if len(p) == 0 {
+		return false
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	for _, network := range p {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// requestHost returns the hostname the request was addressed to without a port.
+func (p trustedProxies) requestHost(r *http.Request) string {
+	host := r.Host
+	if forwarded := r.Header.Get("X-Forwarded-Host"); forwarded != "" && p.trusts(r) {
+		host = strings.TrimSpace(strings.Split(forwarded, ",")[0])
+	}
+
+	return normalizeHost(host)
+}
+
+// normalizeHost lower-cases the provided host and removes any port or trailing dot.
+func normalizeHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// requestScheme returns the scheme the client used to make the request, taking trusted proxies into account.
+func (p trustedProxies) requestScheme(r *http.Request) string {
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" && p.trusts(r) {
+		return strings.ToLower(strings.TrimSpace(strings.Split(proto, ",")[0]))
+	}
+
+	if r.TLS != nil {
+		return "https"
+	}
+
+	return "http"
+}
+
+// canonicalURL returns the location requests should be redirected to when they were not made to the canonical host of
+// the site or, when TLS is enabled and the site requires it, were made over plain HTTP.
+func canonicalURL(r *http.Request, proxies trustedProxies, cfg Config, tls bool) (string, bool) {
+	host := proxies.requestHost(r)
+	scheme := proxies.requestScheme(r)
+
+	target := host
+	if cfg.CanonicalHost != "" {
+		target = strings.ToLower(cfg.CanonicalHost)
+	}
+
+	targetScheme := scheme
+	if tls && cfg.ForceHTTPS {
+		targetScheme = "https"
+	}
+
+	if normalizeHost(target) == host && targetScheme == scheme {
+		return "", false
+	}
+
+	return targetScheme + "://" + target + r.URL.RequestURI(), true
+}
+
+// route matches hostnames ending in a suffix to either a site or a preview pattern.
+type route struct {
+	suffix  string
+	entry   *entry
+	preview *previewSite
+}
+
+// specificity is the number of literal characters in the pattern. Longer patterns are more specific.
+func (r route) specificity() int {
+	if r.preview != nil {
+		return len(r.preview.pattern.prefix) + len(r.preview.pattern.suffix)
+	}
+
+	return len(r.suffix)
+}
+
+// router resolves hostnames to sites. Exact hostnames (including aliases) take precedence, followed by wildcard and
+// preview patterns in order of specificity, and finally the "*" site.
+type router struct {
+	hosts    map[string]*entry
+	routes   []route
+	fallback *entry
+}
+
+func (rt *router) addSite(domain string, entry *entry) error {
+	domain = normalizeHost(domain)
+
+	switch {
+	case domain == "*":
+		rt.fallback = entry
+	case strings.HasPrefix(domain, "*."):
+		rt.routes = append(rt.routes, route{suffix: domain[1:], entry: entry})
+	case rt.hosts[domain] != nil:
+		return errors.Errorf("domain configured more than once: %s", domain)
+	default:
+		rt.hosts[domain] = entry
+	}
+
+	return nil
+}
+
+func (rt *router) addPreview(site *previewSite) {
+	rt.routes = append(rt.routes, route{suffix: site.pattern.suffix, preview: site})
+}
+
+// sort orders the routes from most to least specific. Sites win ties with preview patterns.
+func (rt *router) sort() {
+	sort.SliceStable(rt.routes, func(i, j int) bool {
+		a, b := rt.routes[i], rt.routes[j]
+
+		switch {
+		case a.specificity() != b.specificity():
+			return a.specificity() > b.specificity()
+		case (a.preview == nil) != (b.preview == nil):
+			return a.preview == nil
+		default:
+			return a.suffix < b.suffix
+		}
+	})
+}
+
+// Domains returns the hostnames of every configured site, including their aliases and canonical hosts, that a
+// certificate can be issued for. Wildcard patterns and the fallback site are excluded.
+func (c EndpointConfig) Domains() []string {
+	seen := make(map[string]bool)
+	domains := make([]string, 0, len(c.Sites))
+
+	for domain, cfg := range c.Sites {
+		hosts := append([]string{domain, cfg.CanonicalHost}, cfg.Aliases...)
+
+		for _, host := range hosts {
+			host = normalizeHost(host)
+			if host == "" || strings.Contains(host, "*") || seen[host] {
+				continue
+			}
+
+			seen[host] = true
+			domains = append(domains, host)
+		}
+	}
+
+	sort.Strings(domains)
+	return domains
+}
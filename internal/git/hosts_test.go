@@ -0,0 +1,71 @@
+// Copyright (C) 2022  The pages authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package git
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTrustedProxies(t *testing.T) {
+	proxies, err := parseTrustedProxies("10.0.0.0/8, 192.168.1.1,::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name       string
+		proxies    trustedProxies
+		remoteAddr string
+		host       string
+		scheme     string
+	}{
+		{name: "untrusted client", proxies: proxies, remoteAddr: "203.0.113.7:4321", host: "example.com", scheme: "http"},
+		{name: "no trusted proxies", remoteAddr: "10.1.2.3:4321", host: "example.com", scheme: "http"},
+		{name: "trusted network", proxies: proxies, remoteAddr: "10.1.2.3:4321", host: "forwarded.example.com", scheme: "https"},
+		{name: "trusted address", proxies: proxies, remoteAddr: "192.168.1.1:4321", host: "forwarded.example.com", scheme: "https"},
+		{name: "neighbour of a trusted address", proxies: proxies, remoteAddr: "192.168.1.2:4321", host: "example.com", scheme: "http"},
+		{name: "trusted ipv6 address", proxies: proxies, remoteAddr: "[::1]:4321", host: "forwarded.example.com", scheme: "https"},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = testCase.remoteAddr
+			r.Host = "Example.com:8080"
+			r.Header.Set("X-Forwarded-Host", "forwarded.example.com, proxy.example.com")
+			r.Header.Set("X-Forwarded-Proto", "https")
+
+			if host := testCase.proxies.requestHost(r); host != testCase.host {
+				t.Fatalf("expected host %q, got %q", testCase.host, host)
+			}
+
+			if scheme := testCase.proxies.requestScheme(r); scheme != testCase.scheme {
+				t.Fatalf("expected scheme %q, got %q", testCase.scheme, scheme)
+			}
+		})
+	}
+}
+
+func TestParseTrustedProxiesInvalid(t *testing.T) {
+	for _, list := range []string{"not-an-ip", "10.0.0.0/33", "10.0.0.1,bogus/8"} {
+		if _, err := parseTrustedProxies(list); err == nil {
+			t.Fatalf("expected an error for %q", list)
+		}
+	}
+}
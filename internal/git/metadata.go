@@ -0,0 +1,177 @@
+// Copyright (C) 2022  The pages authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package git
+
+import (
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/pkg/errors"
+)
+
+// maxHistoryDepth bounds the number of commits metadata walks to attribute modification times. Files that were not
+// modified within that many commits (e.g. a LICENSE added in the initial commit) are attributed to the oldest commit
+// visited rather than walking the entire history of the repository.
+const maxHistoryDepth = 250
+
+// fileMeta describes a file as of the commit being served.
+type fileMeta struct {
+	hash     plumbing.Hash
+	modified time.Time
+}
+
+// ETag returns a strong entity tag derived from the hash of the file's blob.
+func (m fileMeta) ETag() string {
+	return `"` + m.hash.String() + `"`
+}
+
+// metadata records the blob hash of every file beneath root along with the time of the last commit that modified it.
+// Times are carried over from the previous revision for files whose contents have not changed, so history only needs
+// to be walked back until every other file has been accounted for. Files whose last change predates a shallow clone,
+// or lies more than maxHistoryDepth commits back, are attributed to the oldest commit visited.
+func metadata(commit *object.Commit, root string, previous map[string]fileMeta) (map[string]fileMeta, error) {
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read tree")
+	}
+
+	prefix := rootPrefix(root)
+
+	files := make(map[string]fileMeta)
+	pending := make(map[string]string)
+
+	err = tree.Files().ForEach(func(file *object.File) error {
+		if !strings.HasPrefix(file.Name, prefix) {
+			return nil
+		}
+
+		name := strings.TrimPrefix(file.Name, prefix)
+		meta := fileMeta{hash: file.Hash}
+
+		if prev, ok := previous[name]; ok && prev.hash == file.Hash {
+			meta.modified = prev.modified
+		} else {
+			pending[file.Name] = name
+		}
+
+		files[name] = meta
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read tree")
+	}
+
+	modified := func(repoPath string, when time.Time) {
+		name := pending[repoPath]
+		delete(pending, repoPath)
+
+		meta := files[name]
+		meta.modified = when
+		files[name] = meta
+	}
+
+	current := commit
+
+	for depth := 1; len(pending) > 0; depth++ {
+		when := current.Committer.When
+
+		if depth > maxHistoryDepth {
+			for repoPath := range pending {
+				modified(repoPath, when)
+			}
+
+			continue
+		}
+
+		parent, err := current.Parent(0)
+		switch {
+		case errors.Is(err, object.ErrParentNotFound), errors.Is(err, plumbing.ErrObjectNotFound):
+			// the root commit, or the oldest commit of a shallow clone
+			for repoPath := range pending {
+				modified(repoPath, when)
+			}
+
+			continue
+		case err != nil:
+			return nil, errors.Wrap(err, "failed to read parent commit")
+		}
+
+		changes, err := diff(parent, current)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, change := range changes {
+			if _, ok := pending[change.To.Name]; ok {
+				modified(change.To.Name, when)
+			}
+		}
+
+		current = parent
+	}
+
+	return files, nil
+}
+
+// rootPrefix returns the prefix of the paths within the repository that belong to the provided root directory.
+func rootPrefix(root string) string {
+	prefix := strings.Trim(path.Clean("/"+root), "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	return prefix
+}
+
+// diff returns the changes made to the tree of the parent by the provided commit.
+func diff(parent, commit *object.Commit) (object.Changes, error) {
+	from, err := parent.Tree()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read tree")
+	}
+
+	to, err := commit.Tree()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read tree")
+	}
+
+	changes, err := object.DiffTree(from, to)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to diff trees")
+	}
+
+	return changes, nil
+}
+
+// metaFileInfo reports the time of the commit that last modified the file as its modification time. The fileMeta is
+// exposed through Sys so the blob hash can be used as an ETag.
+type metaFileInfo struct {
+	os.FileInfo
+	meta fileMeta
+}
+
+func (i *metaFileInfo) ModTime() time.Time {
+	return i.meta.modified
+}
+
+func (i *metaFileInfo) Sys() interface{} {
+	return i.meta
+}
@@ -0,0 +1,149 @@
+// Copyright (C) 2022  The pages authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package git
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+
+	"github.com/mjpitz/myago/clocks"
+	"github.com/mjpitz/myago/zaputil"
+)
+
+// ErrPinned is returned when attempting to synchronize a repository that has been pinned to a commit.
+var ErrPinned = errors.New("repository is pinned")
+
+// Commit summarizes a commit in the history of the tracked reference.
+type Commit struct {
+	Hash    string    `json:"hash"`
+	Author  string    `json:"author"`
+	Message string    `json:"message"`
+	When    time.Time `json:"when"`
+}
+
+// Commits returns up to limit of the most recent commits of the tracked reference. Shallow clones only report the
+// commits that have been fetched.
+func (s *Service) Commits(ctx context.Context, limit int) ([]Commit, error) {
+	unlock, err := s.lock.Lock(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	hash, err := s.Repository.ResolveRevision(plumbing.Revision(tracking(s.Upstream())))
+	if err != nil {
+		return nil, classify(errors.Wrap(err, "failed to resolve reference"))
+	}
+
+	iter, err := s.Repository.Log(&git.LogOptions{From: *hash})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read log")
+	}
+	defer iter.Close()
+
+	commits := make([]Commit, 0, limit)
+
+	err = iter.ForEach(func(commit *object.Commit) error {
+		if len(commits) == limit {
+			return storer.ErrStop
+		}
+
+		commits = append(commits, Commit{
+			Hash:    commit.Hash.String(),
+			Author:  commit.Author.Name,
+			Message: strings.SplitN(strings.TrimSpace(commit.Message), "\n", 2)[0],
+			When:    commit.Author.When,
+		})
+
+		return nil
+	})
+
+	// shallow clones are missing the parents of the oldest commit
+	if err != nil && !errors.Is(err, plumbing.ErrObjectNotFound) {
+		return nil, errors.Wrap(err, "failed to read log")
+	}
+
+	return commits, nil
+}
+
+// Pin checks out the provided commit and suspends synchronization until Unpin is called. The commit must already be
+// present in the local repository.
+func (s *Service) Pin(ctx context.Context, commit string) error {
+	unlock, err := s.lock.Lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	hash, err := s.Repository.ResolveRevision(plumbing.Revision(commit))
+	if err != nil {
+		return classify(errors.Wrapf(err, "failed to resolve commit %s", commit))
+	}
+
+	err = s.swap(ctx, *hash)
+	if err != nil {
+		return err
+	}
+
+	zaputil.Extract(ctx).Info("pinned", zap.String("url", s.options.URL), zap.String("commit", hash.String()))
+
+	s.mu.Lock()
+	s.pinned = true
+	s.mu.Unlock()
+
+	return nil
+}
+
+// Unpin resumes synchronization of the repository and immediately brings it up-to-date with the tracked reference.
+func (s *Service) Unpin(ctx context.Context) error {
+	log := zaputil.Extract(ctx)
+	clock := clocks.Extract(ctx)
+
+	unlock, err := s.lock.Lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	s.mu.Lock()
+	s.pinned = false
+	s.mu.Unlock()
+
+	log.Info("unpinned", zap.String("url", s.options.URL))
+
+	start := clock.Now()
+	err = classify(s.sync(ctx))
+	s.record(start, clock.Now(), err)
+
+	return err
+}
+
+// Pinned returns true when the repository has been pinned to a commit.
+func (s *Service) Pinned() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.pinned
+}
@@ -0,0 +1,343 @@
+// Copyright (C) 2022  The pages authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package git
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/storage/memory"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+
+	"code.pitz.tech/mya/pages/internal/metrics"
+
+	"github.com/mjpitz/myago/clocks"
+	"github.com/mjpitz/myago/zaputil"
+)
+
+const (
+	branchPlaceholder  = "{branch}"
+	defaultMaxPreviews = 10
+)
+
+// PreviewConfig encapsulates the elements that can be configured about branch previews.
+type PreviewConfig struct {
+	Pattern string        `json:"pattern" usage:"hostname pattern used to serve branch previews (e.g. {branch}.preview.example.com), '/' in branch names is written as '--'"`
+	TTL     time.Duration `json:"ttl"     usage:"how long an unused preview is kept around, 0 keeps previews until their branch is deleted" default:"24h"`
+	Max     int           `json:"max"     usage:"the maximum number of previews of the site that are kept at once" default:"10"`
+}
+
+// parsePreviewPattern splits the provided pattern around its branch placeholder.
+func parsePreviewPattern(pattern string) (previewPattern, error) {
+	if strings.Count(pattern, branchPlaceholder) != 1 {
+		return previewPattern{}, errors.Errorf("preview pattern must contain %s exactly once: %s", branchPlaceholder, pattern)
+	}
+
+	parts := strings.SplitN(strings.ToLower(pattern), branchPlaceholder, 2)
+
+	return previewPattern{prefix: parts[0], suffix: parts[1]}, nil
+}
+
+// previewPattern matches hostnames that contain a branch name.
+type previewPattern struct {
+	prefix string
+	suffix string
+}
+
+// Branch extracts the label that addresses a branch from the provided host. Since branches are addressed using a single
+// DNS label, the label is resolved against the branches of the remote using branchLabel.
+func (p previewPattern) Branch(host string) (string, bool) {
+	host = strings.ToLower(host)
+	if len(host) <= len(p.prefix)+len(p.suffix) || !strings.HasPrefix(host, p.prefix) || !strings.HasSuffix(host, p.suffix) {
+		return "", false
+	}
+
+	label := host[len(p.prefix) : len(host)-len(p.suffix)]
+	if strings.Contains(label, ".") {
+		return "", false
+	}
+
+	return label, true
+}
+
+// branchLabel maps a branch name onto the DNS label its preview is addressed by. Names are lower-cased, every '/' is
+// written as "--", and every other character that cannot appear in a hostname is written as '-'. For example, the
+// branches feature/login and dependabot/npm/lodash-4.17.21 are previewed at feature--login and
+// dependabot--npm--lodash-4-17-21 respectively.
+func branchLabel(branch string) string {
+	var label strings.Builder
+
+	for _, r := range strings.ToLower(branch) {
+		switch {
+		case r == '/':
+			label.WriteString("--")
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '-':
+			label.WriteRune(r)
+		default:
+			label.WriteByte('-')
+		}
+	}
+
+	return label.String()
+}
+
+// resolveBranch returns the branch addressed by the provided label. A branch whose name is the label takes precedence
+// over branches whose names map onto it, which are otherwise chosen in lexical order.
+func resolveBranch(branches []string, label string) (string, bool) {
+	sort.Strings(branches)
+
+	for _, branch := range branches {
+		if branch == label {
+			return branch, true
+		}
+	}
+
+	for _, branch := range branches {
+		if branchLabel(branch) == label {
+			return branch, true
+		}
+	}
+
+	return "", false
+}
+
+// previewSite associates a preview pattern with the configuration of the site that declared it.
+type previewSite struct {
+	pattern previewPattern
+	config  Config
+}
+
+// max returns the number of previews of the site that may be kept at once.
+func (s *previewSite) max() int {
+	if s.config.Preview.Max <= 0 {
+		return defaultMaxPreviews
+	}
+
+	return s.config.Preview.Max
+}
+
+// preview is a lazily loaded entry for a single branch. Failed previews are retained until the next collection to
+// avoid repeatedly contacting the remote for branches that do not exist.
+type preview struct {
+	site  *previewSite
+	ready chan struct{}
+	entry *entry
+	err   error
+}
+
+func (p *preview) loaded() bool {
+	select {
+	case <-p.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+// lookupPreview returns the entry used to serve a branch preview for the provided host, cloning the branch if this is
+// the first time it has been requested. Previews are loaded using the context of the endpoint so that they are not
+// cancelled when the client that requested them goes away. Nil is returned when the preview could not be loaded, when
+// the request was cancelled first, or when the site already has as many previews as it is allowed.
+func (e *Endpoint) lookupPreview(ctx context.Context, host, label string, site *previewSite) *entry {
+	e.mu.Lock()
+	p := e.previews[host]
+	if p == nil {
+		if e.countPreviews(site) >= site.max() {
+			e.mu.Unlock()
+
+			zaputil.Extract(ctx).Warn("too many previews", zap.String("domain", host), zap.Int("max", site.max()))
+			return nil
+		}
+
+		p = &preview{site: site, ready: make(chan struct{})}
+		e.previews[host] = p
+
+		go func() {
+			defer close(p.ready)
+			p.entry, p.err = e.loadPreview(e.ctx, host, label, site.config)
+		}()
+	}
+	e.mu.Unlock()
+
+	select {
+	case <-ctx.Done():
+		return nil
+	case <-p.ready:
+	}
+
+	if p.err != nil {
+		return nil
+	}
+
+	p.entry.touch(clocks.Extract(ctx).Now())
+	return p.entry
+}
+
+// countPreviews returns the number of previews of the site that are loaded or being loaded. Callers must hold e.mu.
+func (e *Endpoint) countPreviews(site *previewSite) int {
+	count := 0
+	for _, p := range e.previews {
+		if p.site == site && !(p.loaded() && p.err != nil) {
+			count++
+		}
+	}
+
+	return count
+}
+
+func (e *Endpoint) loadPreview(ctx context.Context, host, label string, cfg Config) (*entry, error) {
+	log := zaputil.Extract(ctx)
+	clock := clocks.Extract(ctx)
+
+	cfg.Tag = ""
+	cfg.TagConstraint = ""
+	cfg.Aliases = nil
+	cfg.CanonicalHost = ""
+
+	cacheControl, err := parseCacheControl(cfg.CacheControl)
+	if err != nil {
+		return nil, err
+	}
+
+	// listing the branches is far cheaper than cloning, and avoids creating anything on disk for unknown branches
+	branches, err := remoteBranches(ctx, cfg)
+	if err != nil {
+		log.Error("failed to list branches", zap.String("domain", host), zap.Error(err))
+		return nil, err
+	}
+
+	branch, ok := resolveBranch(branches, label)
+	if !ok {
+		return nil, &SyncError{Reason: ErrReferenceNotFound, Err: errors.Errorf("no branch matches %s", label)}
+	}
+
+	cfg.Branch = branch
+
+	log.Info("loading preview", zap.String("domain", host), zap.String("branch", branch))
+
+	service, err := NewService(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	service.observe = observeSync(host)
+
+	err = service.Load(ctx)
+	if err != nil {
+		log.Error("failed to load preview", zap.String("domain", host), zap.Error(err))
+		metrics.SiteSyncDuration.DeleteLabelValues(host)
+		_ = service.Close()
+		return nil, err
+	}
+
+	entry := &entry{
+		domain:       host,
+		config:       cfg,
+		cacheControl: cacheControl,
+		cache:        e.cache,
+		service:      service,
+		ticker:       clock.NewTicker(cfg.SyncInterval),
+		accessed:     clock.Now(),
+	}
+
+	e.cache.register(host, cfg.CacheSize)
+	entry.report()
+
+	return entry, nil
+}
+
+// remoteBranches lists the names of the branches of the remote repository without fetching any objects.
+func remoteBranches(ctx context.Context, cfg Config) ([]string, error) {
+	auth, err := cfg.auth()
+	if err != nil {
+		return nil, err
+	}
+
+	remote := git.NewRemote(memory.NewStorage(), &config.RemoteConfig{
+		Name: git.DefaultRemoteName,
+		URLs: []string{cfg.URL},
+	})
+
+	refs, err := remote.ListContext(ctx, &git.ListOptions{Auth: auth})
+	if err != nil {
+		return nil, classify(errors.Wrap(err, "failed to list branches"))
+	}
+
+	branches := make([]string, 0, len(refs))
+	for _, ref := range refs {
+		if ref.Name().IsBranch() {
+			branches = append(branches, ref.Name().Short())
+		}
+	}
+
+	return branches, nil
+}
+
+// evict removes the preview for the provided host, if one exists.
+func (e *Endpoint) evict(ctx context.Context, host string) {
+	e.mu.Lock()
+	p := e.previews[host]
+	delete(e.previews, host)
+	e.mu.Unlock()
+
+	if p != nil && p.loaded() && p.entry != nil {
+		zaputil.Extract(ctx).Info("removing preview", zap.String("domain", host))
+		_ = p.entry.close()
+	}
+}
+
+// collect evicts previews that failed to load or have not been requested within their configured TTL.
+func (e *Endpoint) collect(ctx context.Context) {
+	now := clocks.Extract(ctx).Now()
+	hosts := make([]string, 0)
+
+	e.mu.Lock()
+	for host, p := range e.previews {
+		switch {
+		case !p.loaded():
+		case p.err != nil:
+			hosts = append(hosts, host)
+		case p.entry.config.Preview.TTL > 0 && now.Sub(p.entry.lastAccess()) > p.entry.config.Preview.TTL:
+			hosts = append(hosts, host)
+		}
+	}
+	e.mu.Unlock()
+
+	for _, host := range hosts {
+		e.evict(ctx, host)
+	}
+}
+
+// loadedPreviews returns the entries of all previews that have been loaded successfully.
+func (e *Endpoint) loadedPreviews() []*entry {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	entries := make([]*entry, 0, len(e.previews))
+	for _, p := range e.previews {
+		if p.loaded() && p.err == nil {
+			entries = append(entries, p.entry)
+		}
+	}
+
+	return entries
+}
@@ -0,0 +1,188 @@
+// Copyright (C) 2022  The pages authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package git
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/osfs"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/pkg/errors"
+)
+
+// checkout writes the tree of the provided commit into a new directory beneath dir. The returned revision exposes the
+// root portion of the checkout. Checkouts are never modified once written, which allows them to be served while the
+// next revision is being prepared. The metadata of the previous revision, if any, is used to avoid walking the history
+// of unchanged files.
+func checkout(dir, root string, commit *object.Commit, previous *revision) (rev *revision, err error) {
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read tree")
+	}
+
+	var prev map[string]fileMeta
+	if previous != nil {
+		prev = previous.files
+	}
+
+	files, err := metadata(commit, root, prev)
+	if err != nil {
+		return nil, err
+	}
+
+	temp, err := os.MkdirTemp(dir, commit.Hash.String()[:7]+"-*")
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		if err != nil {
+			_ = os.RemoveAll(temp)
+		}
+	}()
+
+	worktree := osfs.New(temp)
+	prefix := rootPrefix(root)
+
+	err = tree.Files().ForEach(func(file *object.File) error {
+		// files outside of the root are never served
+		if !strings.HasPrefix(file.Name, prefix) {
+			return nil
+		}
+
+		return writeFile(worktree, file)
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to write tree")
+	}
+
+	// report the time of the commit rather than the time of the checkout as the modification time of files
+	err = touch(temp, commit.Committer.When)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to set modification times")
+	}
+
+	site := worktree
+	if root := path.Clean("/" + root); root != "/" {
+		site, err = worktree.Chroot(root)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to chroot site")
+		}
+	}
+
+	return &revision{
+		hash:  commit.Hash,
+		dir:   temp,
+		fs:    site,
+		files: files,
+	}, nil
+}
+
+func writeFile(fs billy.Filesystem, file *object.File) error {
+	if file.Mode == filemode.Symlink {
+		target, err := file.Contents()
+		if err != nil {
+			return err
+		}
+
+		return fs.Symlink(target, file.Name)
+	}
+
+	reader, err := file.Reader()
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	writer, err := fs.Create(file.Name)
+	if err != nil {
+		return err
+	}
+	defer writer.Close()
+
+	_, err = io.Copy(writer, reader)
+	return err
+}
+
+// touch sets the modification time of everything beneath dir, except symlinks, to the provided time.
+func touch(dir string, when time.Time) error {
+	return filepath.Walk(dir, func(name string, info fs.FileInfo, err error) error {
+		if err != nil || info.Mode()&fs.ModeSymlink != 0 {
+			return err
+		}
+
+		return os.Chtimes(name, when, when)
+	})
+}
+
+// revision is an immutable checkout of a single commit. Readers acquire the revision for the duration of a request so
+// that the underlying directory isn't removed while it's still being served.
+type revision struct {
+	hash  plumbing.Hash
+	dir   string
+	fs    billy.Filesystem
+	files map[string]fileMeta
+	rules *rules
+
+	mu      sync.Mutex
+	refs    int
+	retired bool
+}
+
+func (r *revision) acquire() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.refs++
+}
+
+func (r *revision) release() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.refs--
+	r.cleanup()
+}
+
+// retire marks the revision as no longer current. Once all in-flight readers have released the revision, the checkout
+// is removed from disk.
+func (r *revision) retire() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.retired = true
+	r.cleanup()
+}
+
+func (r *revision) cleanup() {
+	if r.retired && r.refs == 0 {
+		_ = os.RemoveAll(r.dir)
+
+		// removes the directory of the service once it has been closed, since it otherwise contains the current revision
+		_ = os.Remove(filepath.Dir(r.dir))
+	}
+}
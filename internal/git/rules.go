@@ -0,0 +1,285 @@
+// Copyright (C) 2022  The pages authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package git
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"net/textproto"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/pkg/errors"
+)
+
+const (
+	redirectsFile = "_redirects"
+	headersFile   = "_headers"
+)
+
+// maxRulesFile caps the size of the _redirects and _headers files that will be read from a repository.
+const maxRulesFile = 1 << 20
+
+// rules contain the redirects and headers declared by the _redirects and _headers files at the root of a site. Their
+// syntax follows the one used by Netlify.
+type rules struct {
+	redirects []redirectRule
+	headers   []headerRule
+}
+
+// redirectRule sends requests matching a path pattern to another location. Rules with a 3xx status redirect the
+// client, while any other status rewrites the request and serves the target with that status.
+type redirectRule struct {
+	from   string
+	to     string
+	status int
+	force  bool
+}
+
+// headerRule adds headers to the responses of requests that match a path pattern.
+type headerRule struct {
+	path    string
+	headers http.Header
+}
+
+// loadRules reads the _redirects and _headers files from the root of the provided filesystem. Invalid lines are
+// skipped and reported as problems so that the rest of the site can still be served.
+func loadRules(fs billy.Filesystem) (*rules, []string) {
+	r := &rules{}
+	problems := make([]string, 0)
+
+	err := readRules(fs, redirectsFile, func(line int, text string) {
+		rule, err := parseRedirect(text)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s:%d: %v", redirectsFile, line, err))
+			return
+		}
+
+		r.redirects = append(r.redirects, rule)
+	})
+	if err != nil {
+		problems = append(problems, fmt.Sprintf("%s: %v", redirectsFile, err))
+	}
+
+	var current *headerRule
+
+	err = readRules(fs, headersFile, func(line int, text string) {
+		if !strings.HasPrefix(text, " ") && !strings.HasPrefix(text, "\t") {
+			path := strings.TrimSpace(text)
+			if !strings.HasPrefix(path, "/") {
+				current = nil
+				problems = append(problems, fmt.Sprintf("%s:%d: path must begin with /: %s", headersFile, line, path))
+				return
+			}
+
+			r.headers = append(r.headers, headerRule{path: path, headers: make(http.Header)})
+			current = &r.headers[len(r.headers)-1]
+			return
+		}
+
+		name, value, ok := strings.Cut(strings.TrimSpace(text), ":")
+		switch {
+		case current == nil:
+			problems = append(problems, fmt.Sprintf("%s:%d: header declared without a path", headersFile, line))
+		case !ok || strings.TrimSpace(name) == "":
+			problems = append(problems, fmt.Sprintf("%s:%d: expected \"Name: value\"", headersFile, line))
+		default:
+			current.headers.Add(textproto.TrimString(name), textproto.TrimString(value))
+		}
+	})
+	if err != nil {
+		problems = append(problems, fmt.Sprintf("%s: %v", headersFile, err))
+	}
+
+	return r, problems
+}
+
+// readRules calls fn with every line in the named file that is neither blank nor a comment. Missing files are ignored.
+func readRules(fs billy.Filesystem, name string, fn func(line int, text string)) error {
+	file, err := fs.Open(name)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(io.LimitReader(file, maxRulesFile))
+
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimRight(scanner.Text(), " \t\r")
+		if trimmed := strings.TrimSpace(text); trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+
+		fn(line, text)
+	}
+
+	return scanner.Err()
+}
+
+// parseRedirect parses a single line of a _redirects file (e.g. "/blog/:slug /posts/:slug 301!").
+func parseRedirect(line string) (redirectRule, error) {
+	fields := strings.Fields(line)
+
+	switch {
+	case len(fields) < 2:
+		return redirectRule{}, errors.New("expected a source and a target")
+	case len(fields) > 3:
+		return redirectRule{}, errors.New("conditions are not supported")
+	case !strings.HasPrefix(fields[0], "/"):
+		return redirectRule{}, errors.Errorf("source must begin with /: %s", fields[0])
+	}
+
+	rule := redirectRule{
+		from:   fields[0],
+		to:     fields[1],
+		status: http.StatusMovedPermanently,
+	}
+
+	if len(fields) == 3 {
+		status := fields[2]
+		rule.force = strings.HasSuffix(status, "!")
+
+		code, err := strconv.Atoi(strings.TrimSuffix(status, "!"))
+		if err != nil || code < 200 || code > 599 {
+			return redirectRule{}, errors.Errorf("invalid status: %s", status)
+		}
+
+		rule.status = code
+	}
+
+	absolute := strings.HasPrefix(rule.to, "http://") || strings.HasPrefix(rule.to, "https://")
+
+	switch {
+	case !absolute && !strings.HasPrefix(rule.to, "/"):
+		return redirectRule{}, errors.Errorf("target must begin with / or be an absolute url: %s", rule.to)
+	case absolute && !rule.redirect():
+		return redirectRule{}, errors.Errorf("proxying to %s is not supported", rule.to)
+	}
+
+	return rule, nil
+}
+
+// redirect returns true when the client should be sent to the target, rather than having the target served in place.
+func (r redirectRule) redirect() bool {
+	return r.status >= 300 && r.status < 400
+}
+
+// target expands the placeholders and splat captured by match in the rule's destination.
+func (r redirectRule) target(params map[string]string) string {
+	names := make([]string, 0, len(params))
+	for name := range params {
+		names = append(names, name)
+	}
+
+	// replace longer names first so that :id does not clobber :identifier
+	sort.Slice(names, func(i, j int) bool { return len(names[i]) > len(names[j]) })
+
+	to := r.to
+	for _, name := range names {
+		to = strings.ReplaceAll(to, ":"+name, params[name])
+	}
+
+	return to
+}
+
+// match compares a request path against a rule pattern. Patterns may contain :placeholder segments, which match a
+// single path segment, and end in a * that matches the remainder of the path and is exposed as :splat.
+func match(pattern, path string) (map[string]string, bool) {
+	pattern = strings.TrimSuffix(pattern, "/")
+	path = strings.TrimSuffix(path, "/")
+
+	patternSegments := strings.Split(pattern, "/")
+	pathSegments := strings.Split(path, "/")
+	params := make(map[string]string)
+
+	for i, segment := range patternSegments {
+		switch {
+		case segment == "*" && i == len(patternSegments)-1:
+			if i < len(pathSegments) {
+				params["splat"] = strings.Join(pathSegments[i:], "/")
+			} else {
+				params["splat"] = ""
+			}
+
+			return params, true
+		case i >= len(pathSegments):
+			return nil, false
+		case strings.HasPrefix(segment, ":") && pathSegments[i] != "":
+			params[segment[1:]] = pathSegments[i]
+		case segment != pathSegments[i]:
+			return nil, false
+		}
+	}
+
+	return params, len(patternSegments) == len(pathSegments)
+}
+
+// header returns a copy of the headers that apply to the provided path. When several rules set the same header, the
+// last one declared wins.
+func (r *rules) header(path string) http.Header {
+	headers := make(http.Header)
+
+	for _, rule := range r.headers {
+		if _, ok := match(rule.path, path); ok {
+			for name, values := range rule.headers {
+				// the values are copied since responses may append to them (e.g. Vary)
+				headers[name] = append([]string(nil), values...)
+			}
+		}
+	}
+
+	return headers
+}
+
+// redirect returns the first redirect rule that matches the provided path along with its expanded target. Rules that
+// are not forced only apply when no file exists at the path.
+func (r *rules) redirect(path string, exists func() bool) (redirectRule, string, bool) {
+	checked, found := false, false
+
+	for _, rule := range r.redirects {
+		params, ok := match(rule.from, path)
+		if !ok {
+			continue
+		}
+
+		if !rule.force {
+			if !checked {
+				checked, found = true, exists()
+			}
+
+			if found {
+				continue
+			}
+		}
+
+		return rule, rule.target(params), true
+	}
+
+	return redirectRule{}, "", false
+}
+
+// reserved returns true for the paths of the rule files themselves, which are never served.
+func reserved(path string) bool {
+	return path == "/"+redirectsFile || path == "/"+headersFile
+}
@@ -0,0 +1,204 @@
+// Copyright (C) 2022  The pages authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package git
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestMatch(t *testing.T) {
+	testCases := []struct {
+		pattern string
+		path    string
+		params  map[string]string
+		ok      bool
+	}{
+		{pattern: "/about", path: "/about", params: map[string]string{}, ok: true},
+		{pattern: "/about", path: "/about/", params: map[string]string{}, ok: true},
+		{pattern: "/about", path: "/contact"},
+		{pattern: "/about", path: "/about/team"},
+		{pattern: "/blog/:slug", path: "/blog/hello", params: map[string]string{"slug": "hello"}, ok: true},
+		{pattern: "/blog/:slug", path: "/blog"},
+		{pattern: "/blog/:slug", path: "/blog/hello/world"},
+		{pattern: "/:year/:month", path: "/2022/05", params: map[string]string{"year": "2022", "month": "05"}, ok: true},
+		{pattern: "/docs/*", path: "/docs/a/b.html", params: map[string]string{"splat": "a/b.html"}, ok: true},
+		{pattern: "/docs/*", path: "/docs", params: map[string]string{"splat": ""}, ok: true},
+		{pattern: "/docs/*", path: "/other/a"},
+		{pattern: "/*", path: "/anything/at/all", params: map[string]string{"splat": "anything/at/all"}, ok: true},
+		{pattern: "/blog/:slug/*", path: "/blog/hello/a/b", params: map[string]string{"slug": "hello", "splat": "a/b"}, ok: true},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.pattern+" "+testCase.path, func(t *testing.T) {
+			params, ok := match(testCase.pattern, testCase.path)
+			if ok != testCase.ok {
+				t.Fatalf("expected ok to be %t, got %t", testCase.ok, ok)
+			}
+
+			if ok && !reflect.DeepEqual(params, testCase.params) {
+				t.Fatalf("expected params %v, got %v", testCase.params, params)
+			}
+		})
+	}
+}
+
+func TestParseRedirect(t *testing.T) {
+	testCases := []struct {
+		line string
+		rule redirectRule
+		err  bool
+	}{
+		{line: "/old /new", rule: redirectRule{from: "/old", to: "/new", status: http.StatusMovedPermanently}},
+		{line: "/old /new 302", rule: redirectRule{from: "/old", to: "/new", status: http.StatusFound}},
+		{line: "/old   /new\t301!", rule: redirectRule{from: "/old", to: "/new", status: http.StatusMovedPermanently, force: true}},
+		{line: "/app/* /index.html 200", rule: redirectRule{from: "/app/*", to: "/index.html", status: http.StatusOK}},
+		{line: "/gone /404.html 404!", rule: redirectRule{from: "/gone", to: "/404.html", status: http.StatusNotFound, force: true}},
+		{line: "/ext https://example.com/:splat 301", rule: redirectRule{from: "/ext", to: "https://example.com/:splat", status: http.StatusMovedPermanently}},
+		{line: "/only-source", err: true},
+		{line: "/a /b 301 Country=us", err: true},
+		{line: "relative /b", err: true},
+		{line: "/a relative", err: true},
+		{line: "/a /b abc", err: true},
+		{line: "/a /b 600", err: true},
+		{line: "/a /b 100", err: true},
+		{line: "/proxy https://example.com 200", err: true},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.line, func(t *testing.T) {
+			rule, err := parseRedirect(testCase.line)
+
+			switch {
+			case testCase.err && err == nil:
+				t.Fatalf("expected an error, got %+v", rule)
+			case !testCase.err && err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			case !testCase.err && rule != testCase.rule:
+				t.Fatalf("expected %+v, got %+v", testCase.rule, rule)
+			}
+		})
+	}
+}
+
+func TestRedirectTarget(t *testing.T) {
+	testCases := []struct {
+		to     string
+		params map[string]string
+		target string
+	}{
+		{to: "/posts/:slug", params: map[string]string{"slug": "hello"}, target: "/posts/hello"},
+		{to: "/new/:splat", params: map[string]string{"splat": "a/b.html"}, target: "/new/a/b.html"},
+		{to: "/:year/:month/:year", params: map[string]string{"year": "2022", "month": "05"}, target: "/2022/05/2022"},
+		{to: "/:identifier/:id", params: map[string]string{"id": "1", "identifier": "abc"}, target: "/abc/1"},
+		{to: "/static", params: map[string]string{"unused": "x"}, target: "/static"},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.to, func(t *testing.T) {
+			target := redirectRule{to: testCase.to}.target(testCase.params)
+			if target != testCase.target {
+				t.Fatalf("expected %q, got %q", testCase.target, target)
+			}
+		})
+	}
+}
+
+func TestRulesRedirect(t *testing.T) {
+	r := &rules{}
+	for _, line := range []string{
+		"/docs/* /documentation/:splat 301",
+		"/blog/:slug /posts/:slug 302!",
+		"/app/* /app/index.html 200",
+	} {
+		rule, err := parseRedirect(line)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r.redirects = append(r.redirects, rule)
+	}
+
+	testCases := []struct {
+		name   string
+		path   string
+		exists bool
+		target string
+		status int
+		ok     bool
+	}{
+		{name: "unforced rule", path: "/docs/a/b", target: "/documentation/a/b", status: http.StatusMovedPermanently, ok: true},
+		{name: "unforced rule shadowed by a file", path: "/docs/a/b", exists: true},
+		{name: "forced rule", path: "/blog/hello", target: "/posts/hello", status: http.StatusFound, ok: true},
+		{name: "forced rule over a file", path: "/blog/hello", exists: true, target: "/posts/hello", status: http.StatusFound, ok: true},
+		{name: "rewrite", path: "/app/settings", target: "/app/index.html", status: http.StatusOK, ok: true},
+		{name: "rewrite shadowed by a file", path: "/app/settings", exists: true},
+		{name: "no matching rule", path: "/other"},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			rule, target, ok := r.redirect(testCase.path, func() bool { return testCase.exists })
+
+			switch {
+			case ok != testCase.ok:
+				t.Fatalf("expected ok to be %t, got %t", testCase.ok, ok)
+			case !ok:
+			case target != testCase.target:
+				t.Fatalf("expected target %q, got %q", testCase.target, target)
+			case rule.status != testCase.status:
+				t.Fatalf("expected status %d, got %d", testCase.status, rule.status)
+			}
+		})
+	}
+}
+
+func TestRulesRedirectChecksExistenceOnce(t *testing.T) {
+	r := &rules{redirects: []redirectRule{
+		{from: "/a", to: "/b", status: http.StatusMovedPermanently},
+		{from: "/*", to: "/c", status: http.StatusMovedPermanently},
+	}}
+
+	calls := 0
+	_, _, ok := r.redirect("/a", func() bool {
+		calls++
+		return true
+	})
+
+	if ok || calls != 1 {
+		t.Fatalf("expected no redirect after a single existence check, got ok=%t after %d checks", ok, calls)
+	}
+}
+
+func TestRulesHeader(t *testing.T) {
+	r := &rules{headers: []headerRule{
+		{path: "/*", headers: http.Header{"Vary": {"Accept-Language"}, "X-Frame-Options": {"DENY"}}},
+		{path: "/embed/*", headers: http.Header{"X-Frame-Options": {"SAMEORIGIN"}}},
+	}}
+
+	header := r.header("/embed/widget")
+	if got := header.Get("X-Frame-Options"); got != "SAMEORIGIN" {
+		t.Fatalf("expected the last matching rule to win, got %q", got)
+	}
+
+	header.Add("Vary", "Accept-Encoding")
+
+	if values := r.headers[0].headers["Vary"]; len(values) != 1 {
+		t.Fatalf("expected the rule to be unaffected by changes to the response, got %v", values)
+	}
+}
@@ -0,0 +1,321 @@
+// Copyright (C) 2022  The pages authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package git
+
+import (
+	"fmt"
+	"html"
+	"io/fs"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"code.pitz.tech/mya/pages/internal/compress"
+	"code.pitz.tech/mya/pages/internal/web"
+)
+
+const (
+	// TrailingSlashAuto adds a trailing slash to directories and removes it from files, like http.FileServer does.
+	TrailingSlashAuto = "auto"
+	// TrailingSlashAlways adds a trailing slash to every page.
+	TrailingSlashAlways = "always"
+	// TrailingSlashNever removes the trailing slash from every page.
+	TrailingSlashNever = "never"
+
+	// ListingNone responds with a 404 for directories without an index.html.
+	ListingNone = "none"
+	// ListingPlain renders a plain list of the files within directories without an index.html.
+	ListingPlain = "plain"
+	// ListingStyled renders a styled, sortable table of the files within directories without an index.html.
+	ListingStyled = "styled"
+)
+
+// page is the resolved target of a request.
+type page struct {
+	name string
+	file http.File
+	info fs.FileInfo
+
+	// dir is set when the page is a directory, or the index of one, which affects the trailing slash policy
+	dir bool
+}
+
+// resolve locates the file that should be served for the provided path. Directories resolve to their index.html when
+// present. With clean URLs enabled, extensionless paths that are not files resolve to the file of the same name with a
+// .html suffix before falling back to the directory (e.g. /about serves about.html rather than about/index.html).
+func resolve(files http.FileSystem, name string, cleanURLs bool) (*page, error) {
+	clean := cleanURLs && name != "/" && path.Ext(name) == ""
+
+	file, err := files.Open(name)
+	if err != nil {
+		if !os.IsNotExist(err) || !clean {
+			return nil, err
+		}
+
+		return resolveFile(files, name+".html", false)
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+
+	if !info.IsDir() {
+		return &page{name: name, file: file, info: info}, nil
+	}
+
+	if clean {
+		if html, err := resolveFile(files, name+".html", false); err == nil {
+			_ = file.Close()
+			return html, nil
+		}
+	}
+
+	index, err := resolveFile(files, path.Join(name, "index.html"), true)
+	if err == nil {
+		_ = file.Close()
+		return index, nil
+	}
+
+	return &page{name: name, file: file, info: info, dir: true}, nil
+}
+
+// resolveFile opens the named file, ignoring directories.
+func resolveFile(files http.FileSystem, name string, dir bool) (*page, error) {
+	file, err := files.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := file.Stat()
+	switch {
+	case err != nil:
+		_ = file.Close()
+		return nil, err
+	case info.IsDir():
+		_ = file.Close()
+		return nil, fs.ErrNotExist
+	}
+
+	return &page{name: name, file: file, info: info, dir: dir}, nil
+}
+
+// servable returns true when serveFile would respond with the contents of a file or a directory listing.
+func servable(files http.FileSystem, name string, cfg Config) bool {
+	p, err := resolve(files, path.Clean("/"+name), cfg.CleanURLs)
+	if err != nil {
+		return false
+	}
+	defer p.file.Close()
+
+	return !p.info.IsDir() || cfg.Listing == ListingPlain || cfg.Listing == ListingStyled
+}
+
+// precompressed returns a compressed sibling of the page (e.g. app.js.br for app.js) that is accepted by the client.
+// The sibling keeps the name of the page so that the Content-Type is determined from the original file. Pages whose
+// Content-Type cannot be determined from their extension are always served uncompressed.
+func precompressed(files http.FileSystem, r *http.Request, p *page) (*page, string) {
+	contentType := mime.TypeByExtension(path.Ext(p.name))
+	if contentType == "" {
+		return nil, ""
+	}
+
+	for _, encoding := range compress.Encodings {
+		if !compress.Accepts(r, encoding) {
+			continue
+		}
+
+		sibling, err := resolveFile(files, p.name+compress.Extension(encoding), false)
+		if err != nil {
+			continue
+		}
+
+		sibling.name = p.name
+		sibling.info = &namedFileInfo{FileInfo: sibling.info, name: p.info.Name()}
+		return sibling, encoding
+	}
+
+	return nil, ""
+}
+
+// namedFileInfo overrides the name of a file so that http.ServeContent determines the Content-Type from it.
+type namedFileInfo struct {
+	fs.FileInfo
+	name string
+}
+
+func (i *namedFileInfo) Name() string {
+	return i.name
+}
+
+// trailingSlash returns the location the request should be redirected to in order to comply with the provided policy.
+// Files with an extension are always served without a trailing slash.
+func trailingSlash(policy string, r *http.Request, p *page) (string, bool) {
+	current := r.URL.Path
+	if current == "/" {
+		return "", false
+	}
+
+	slash := strings.HasSuffix(current, "/")
+	trimmed := strings.TrimSuffix(current, "/")
+
+	var want bool
+
+	switch {
+	case !p.dir && path.Ext(trimmed) != "":
+		want = false
+	case policy == TrailingSlashAlways:
+		want = true
+	case policy == TrailingSlashNever:
+		want = false
+	default:
+		want = p.dir
+	}
+
+	if want == slash {
+		return "", false
+	}
+
+	location := trimmed
+	if want {
+		location += "/"
+	}
+
+	if r.URL.RawQuery != "" {
+		location += "?" + r.URL.RawQuery
+	}
+
+	return location, true
+}
+
+// serveFile serves the requested path from the provided files according to the site's configuration. Redirects that
+// enforce the trailing slash policy are only issued when redirect is set, since rewritten requests must be served in
+// place.
+func serveFile(w http.ResponseWriter, r *http.Request, files http.FileSystem, site *entry, redirect bool) {
+	cfg := site.config
+	name := path.Clean("/" + r.URL.Path)
+
+	p, err := resolve(files, name, cfg.CleanURLs)
+
+	switch {
+	case os.IsNotExist(err):
+		http.NotFound(w, r)
+		return
+	case err != nil:
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	defer p.file.Close()
+
+	policy := cfg.TrailingSlash
+	if policy == "" {
+		policy = TrailingSlashAuto
+	}
+
+	if location, ok := trailingSlash(policy, r, p); ok && redirect {
+		http.Redirect(w, r, location, http.StatusMovedPermanently)
+		return
+	}
+
+	if !p.info.IsDir() {
+		compress.Vary(w.Header())
+
+		if sibling, encoding := precompressed(files, r, p); sibling != nil {
+			defer sibling.file.Close()
+
+			w.Header().Set("Content-Encoding", encoding)
+			p = sibling
+		}
+	}
+
+	if meta, ok := p.info.Sys().(fileMeta); ok {
+		w.Header().Set("ETag", meta.ETag())
+	}
+
+	// headers provided by the repository take precedence over the configured policy
+	switch {
+	case w.Header().Get("Cache-Control") != "":
+	case p.info.IsDir():
+		// listings are html
+		w.Header().Set("Cache-Control", "no-cache")
+	default:
+		w.Header().Set("Cache-Control", site.cacheControl.header(p.name))
+	}
+
+	if !p.info.IsDir() {
+		http.ServeContent(w, r, p.info.Name(), p.info.ModTime(), p.file)
+		return
+	}
+
+	switch cfg.Listing {
+	case ListingPlain, ListingStyled:
+		listDirectory(w, r, p.file, cfg.Listing)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// listDirectory renders the files within the provided directory using the provided listing style.
+func listDirectory(w http.ResponseWriter, r *http.Request, dir http.File, style string) {
+	infos, err := dir.Readdir(-1)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	// links are relative to the directory, which may be served without a trailing slash
+	base := path.Base(path.Clean("/"+r.URL.Path)) + "/"
+	if strings.HasSuffix(r.URL.Path, "/") || base == "//" {
+		base = ""
+	}
+
+	if style == ListingStyled {
+		entries := make([]web.ListingEntry, 0, len(infos))
+		for _, info := range infos {
+			entries = append(entries, web.ListingEntry{
+				Name:    info.Name(),
+				Dir:     info.IsDir(),
+				Size:    info.Size(),
+				ModTime: info.ModTime(),
+			})
+		}
+
+		web.Listing(w, r, base, entries)
+		return
+	}
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+
+	_, _ = fmt.Fprintf(w, "<pre>\n")
+	for _, info := range infos {
+		name := info.Name()
+		if info.IsDir() {
+			name += "/"
+		}
+
+		link := url.URL{Path: base + name}
+		_, _ = fmt.Fprintf(w, "<a href=\"%s\">%s</a>\n", html.EscapeString(link.String()), html.EscapeString(name))
+	}
+	_, _ = fmt.Fprintf(w, "</pre>\n")
+}
@@ -18,50 +18,226 @@ package git
 
 import (
 	"context"
+	"fmt"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
-	"github.com/go-git/go-billy/v5"
 	"github.com/go-git/go-billy/v5/osfs"
 	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
 	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/cache"
+	"github.com/go-git/go-git/v5/plumbing/transport"
 	"github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/go-git/go-git/v5/plumbing/transport/ssh"
+	"github.com/go-git/go-git/v5/storage"
+	"github.com/go-git/go-git/v5/storage/filesystem"
 	"github.com/go-git/go-git/v5/storage/memory"
 	"github.com/pkg/errors"
 	"go.uber.org/zap"
 
+	"code.pitz.tech/mya/pages/internal/lock"
+
+	"github.com/mjpitz/myago/clocks"
 	"github.com/mjpitz/myago/zaputil"
 )
 
 // Config encapsulates the elements that can be configured about the git service.
 type Config struct {
-	URL          string        `json:"url"           usage:"the git url used to clone the repository"`
-	Branch       string        `json:"branch"        usage:"the name of the git branch to clone"`
-	Tag          string        `json:"tag"           usage:"the name of the git tag to clone"`
-	Username     string        `json:"username"      usage:"the username used to authenticate with the git service"`
-	Password     string        `json:"password"      usage:"the password used to authenticate with the git service"`
-	SyncInterval time.Duration `json:"sync_interval" usage:"how frequently the git repository is pulled for changes" default:"1h"`
+	URL           string             `json:"url"            usage:"the git url used to clone the repository"`
+	Branch        string             `json:"branch"         usage:"the name of the git branch to clone"`
+	Tag           string             `json:"tag"            usage:"the name of the git tag to clone"`
+	TagConstraint string             `json:"tag_constraint" usage:"track the highest semver tag matching the constraint (e.g. ^1.2, >=2.0.0, latest)"`
+	Root          string             `json:"root"           usage:"the directory within the repository to serve as the site root"`
+	Depth         int                `json:"depth"          usage:"limit fetching to the specified number of commits, 0 fetches the full history"`
+	SingleBranch  bool               `json:"single_branch"  usage:"only fetch the branch or tag being served"`
+	Storage       string             `json:"storage"        usage:"where git objects are stored (memory or filesystem)" default:"memory"`
+	Username      string             `json:"username"       usage:"the username used to authenticate with the git service"`
+	Password      string             `json:"password"       usage:"the password used to authenticate with the git service"`
+	SSH           SSHConfig          `json:"ssh"`
+	WebhookSecret string             `json:"webhook_secret" usage:"the secret used to verify webhook deliveries from the git service"`
+	Hidden        HiddenConfig       `json:"hidden"`
+	Preview       PreviewConfig      `json:"preview"`
+	SyncInterval  time.Duration      `json:"sync_interval"  usage:"how frequently the git repository is pulled for changes" default:"1h"`
+	Aliases       []string           `json:"aliases"        usage:"additional hostnames that serve the site"`
+	CanonicalHost string             `json:"canonical_host" usage:"permanently redirect requests for any other hostname of the site to this host"`
+	ForceHTTPS    bool               `json:"force_https"    usage:"permanently redirect plain HTTP requests to HTTPS when TLS is enabled"`
+	HSTS          HSTSConfig         `json:"hsts"`
+	SPAFallback   bool               `json:"spa_fallback"   usage:"serve the spa_document for html requests that do not match a file (for client-side routing)"`
+	SPADocument   string             `json:"spa_document"   usage:"the document served by the spa_fallback" default:"index.html"`
+	CleanURLs     bool               `json:"clean_urls"     usage:"serve extensionless paths from the .html file of the same name"`
+	TrailingSlash string             `json:"trailing_slash" usage:"whether pages are redirected to add or remove a trailing slash (auto, always, or never)" default:"auto"`
+	Listing       string             `json:"listing"        usage:"how directories without an index.html are served (none, plain, or styled)" default:"none"`
+	CacheControl  CacheControlConfig `json:"cache_control"`
+	CacheSize     int                `json:"cache_size"     usage:"maximum number of megabytes of the site's files kept in memory, 0 only applies the global limit"`
+}
+
+// Redacted returns a copy of the Config with any secrets removed.
+func (c Config) Redacted() Config {
+	c.Password = ""
+	c.SSH.KeyPassphrase = ""
+	c.WebhookSecret = ""
+
+	return c
+}
+
+// SSHConfig encapsulates the elements that can be configured when cloning over ssh.
+type SSHConfig struct {
+	KeyFile       string `json:"key_file"       usage:"path to the private key used to authenticate with the git service"`
+	KeyPassphrase string `json:"key_passphrase" usage:"the passphrase used to decrypt the private key"`
+	KnownHosts    string `json:"known_hosts"    usage:"path to the known_hosts file used to verify the host key of the git service"`
+}
+
+// HSTSConfig encapsulates the HTTP Strict Transport Security policy sent with responses to HTTPS requests.
+type HSTSConfig struct {
+	MaxAge            time.Duration `json:"max_age"            usage:"how long clients should only connect to the site using HTTPS, 0 disables the header"`
+	IncludeSubDomains bool          `json:"include_subdomains" usage:"apply the policy to every subdomain of the site"`
+	Preload           bool          `json:"preload"            usage:"consent to the site being included in the HSTS preload lists of browsers"`
+}
+
+// header returns the value of the Strict-Transport-Security header for the policy.
+func (c HSTSConfig) header() string {
+	header := "max-age=" + strconv.Itoa(int(c.MaxAge.Seconds()))
+	if c.IncludeSubDomains {
+		header += "; includeSubDomains"
+	}
+
+	if c.Preload {
+		header += "; preload"
+	}
+
+	return header
+}
+
+// HiddenConfig encapsulates the policy used to serve hidden files and directories (those beginning with a dot).
+type HiddenConfig struct {
+	Serve bool   `json:"serve" usage:"serve hidden files and directories from the repository"`
+	Allow string `json:"allow" usage:"comma separated list of hidden paths that are always served" default:".well-known"`
+}
+
+// options produces the HTTPOption set used to serve the repository. An empty allow list permits no hidden paths. Sites
+// loaded from a site file do not receive the flag default and must list ".well-known" explicitly to serve it.
+func (c HiddenConfig) options() []HTTPOption {
+	return []HTTPOption{
+		ServeHidden(c.Serve),
+		AllowHidden(strings.Split(c.Allow, ",")...),
+	}
+}
+
+// auth produces the transport.AuthMethod used to clone and pull the repository. Credentials are selected based on the
+// protocol of the configured URL.
+func (c Config) auth() (transport.AuthMethod, error) {
+	endpoint, err := transport.NewEndpoint(c.URL)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse url")
+	}
+
+	if endpoint.Protocol != "ssh" {
+		if c.Username != "" && c.Password != "" {
+			return &http.BasicAuth{
+				Username: c.Username,
+				Password: c.Password,
+			}, nil
+		}
+
+		return nil, nil
+	}
+
+	user := endpoint.User
+	switch {
+	case c.Username != "":
+		user = c.Username
+	case user == "":
+		user = "git"
+	}
+
+	var auth ssh.AuthMethod
+
+	switch {
+	case c.SSH.KeyFile != "":
+		keys, err := ssh.NewPublicKeysFromFile(user, c.SSH.KeyFile, c.SSH.KeyPassphrase)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to load private key")
+		}
+
+		auth = keys
+	case c.Password != "":
+		auth = &ssh.Password{User: user, Password: c.Password}
+	default:
+		// fall back to the ssh-agent, similar to how the git cli behaves
+		agent, err := ssh.NewSSHAgentAuth(user)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to connect to ssh-agent")
+		}
+
+		auth = agent
+	}
+
+	if c.SSH.KnownHosts != "" {
+		callback, err := ssh.NewKnownHostsCallback(c.SSH.KnownHosts)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to load known_hosts")
+		}
+
+		switch v := auth.(type) {
+		case *ssh.PublicKeys:
+			v.HostKeyCallback = callback
+		case *ssh.Password:
+			v.HostKeyCallback = callback
+		case *ssh.PublicKeysCallback:
+			v.HostKeyCallback = callback
+		}
+	}
+
+	return auth, nil
 }
 
 // NewService constructs a Service that manages the underlying git repository.
 func NewService(config Config) (*Service, error) {
+	auth, err := config.auth()
+	if err != nil {
+		return nil, err
+	}
+
 	temp, err := os.MkdirTemp(os.TempDir(), "pages-*")
 	if err != nil {
 		return nil, err
 	}
 
+	var store storage.Storer
+
+	switch config.Storage {
+	case "", "memory":
+		store = memory.NewStorage()
+	case "filesystem":
+		store = filesystem.NewStorage(osfs.New(filepath.Join(temp, "git")), cache.NewObjectLRUDefault())
+	default:
+		return nil, errors.Errorf("unsupported storage: %s", config.Storage)
+	}
+
 	options := &git.CloneOptions{
-		URL: config.URL,
+		URL:          config.URL,
+		Auth:         auth,
+		Depth:        config.Depth,
+		SingleBranch: config.SingleBranch,
 	}
 
-	if config.Username != "" && config.Password != "" {
-		options.Auth = &http.BasicAuth{
-			Username: config.Username,
-			Password: config.Password,
-		}
+	if config.SingleBranch {
+		options.Tags = git.NoTags
 	}
 
+	var constraint *tagConstraint
+
 	switch {
+	case config.TagConstraint != "":
+		constraint, err = parseTagConstraint(config.TagConstraint)
+		if err != nil {
+			return nil, err
+		}
 	case config.Tag != "":
 		options.ReferenceName = plumbing.NewTagReferenceName(config.Tag)
 	case config.Branch != "":
@@ -69,54 +245,337 @@ func NewService(config Config) (*Service, error) {
 	}
 
 	return &Service{
-		options: options,
-		Store:   memory.NewStorage(),
-		FS:      osfs.New(temp),
+		options:    options,
+		constraint: constraint,
+		dir:        temp,
+		root:       config.Root,
+		lock:       lock.New(),
+		Store:      store,
 	}, nil
 }
 
 // Service encapsulates operations that can be performed against the target git repository.
 type Service struct {
 	options    *git.CloneOptions
-	Store      *memory.Storage
-	FS         billy.Filesystem
+	constraint *tagConstraint
+	dir        string
+	root       string
+
+	// lock serializes operations against the repository, while mu guards the fields that are read when serving.
+	lock     lock.Lock
+	mu       sync.RWMutex
+	upstream plumbing.ReferenceName
+	current  *revision
+	closed   bool
+	pinned   bool
+	state    SyncState
+
+	// observe is called with the duration of every attempt to synchronize the repository
+	observe func(time.Duration)
+
+	Store      storage.Storer
 	Repository *git.Repository
 }
 
+// SyncState describes the outcome of the most recent attempts to synchronize the repository.
+type SyncState struct {
+	LastAttempt time.Time     `json:"last_attempt"`
+	LastSuccess time.Time     `json:"last_success"`
+	Duration    time.Duration `json:"duration"`
+	Failures    int           `json:"consecutive_failures"`
+	Error       string        `json:"error,omitempty"`
+	Warnings    []string      `json:"warnings,omitempty"`
+}
+
+// tracking returns the local reference used to track the provided upstream reference.
+func tracking(upstream plumbing.ReferenceName) plumbing.ReferenceName {
+	if upstream.IsBranch() {
+		return plumbing.NewRemoteReferenceName(git.DefaultRemoteName, upstream.Short())
+	}
+
+	return upstream
+}
+
 // Load initializes the git repository given the provided options. This _should_ only be called once.
 func (s *Service) Load(ctx context.Context) (err error) {
+	clock := clocks.Extract(ctx)
+
 	zaputil.Extract(ctx).Info("cloning", zap.String("url", s.options.URL))
 
-	s.Repository, err = git.CloneContext(ctx, s.Store, s.FS, s.options)
+	unlock, err := s.lock.Lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	start := clock.Now()
+	defer func() {
+		err = classify(err)
+		s.record(start, clock.Now(), err)
+	}()
+
+	if s.constraint != nil {
+		s.options.ReferenceName, err = s.constraint.Select(ctx, s.options.URL, s.options.Auth)
+		if err != nil {
+			return err
+		}
+	}
+
+	// clone without a worktree, revisions are checked out separately so they can be swapped out atomically
+	s.Repository, err = git.CloneContext(ctx, s.Store, nil, s.options)
 	if err != nil {
 		return errors.Wrap(err, "failed to clone repository")
 	}
 
-	return nil
+	upstream := s.options.ReferenceName
+	if !upstream.IsTag() {
+		head, err := s.Repository.Reference(plumbing.HEAD, false)
+		if err != nil {
+			return errors.Wrap(err, "failed to resolve HEAD")
+		}
+
+		// HEAD points at the default branch when none was configured
+		upstream = head.Target()
+	}
+
+	return s.update(ctx, upstream)
 }
 
-// Sync pulls the underlying repository to ensure it's up-to-date.
+// Sync fetches the underlying repository and swaps in the latest revision once it has been checked out. Failures are
+// recorded in the SyncState of the service and returned as a SyncError when their reason is known.
 func (s *Service) Sync(ctx context.Context) error {
-	zaputil.Extract(ctx).Info("synchronizing", zap.String("url", s.options.URL))
+	log := zaputil.Extract(ctx)
+	clock := clocks.Extract(ctx)
+
+	log.Info("synchronizing", zap.String("url", s.options.URL))
 
-	wt, err := s.Repository.Worktree()
+	unlock, err := s.lock.Lock(ctx)
 	if err != nil {
-		return errors.Wrap(err, "failed to obtain worktree")
+		return err
 	}
+	defer unlock()
+
+	if s.Pinned() {
+		log.Info("skipping pinned repository", zap.String("url", s.options.URL))
+		return &SyncError{Reason: ErrConflict, Err: ErrPinned}
+	}
+
+	start := clock.Now()
+	err = classify(s.sync(ctx))
+	s.record(start, clock.Now(), err)
 
-	err = wt.PullContext(ctx, &git.PullOptions{
-		ReferenceName: s.options.ReferenceName,
-		SingleBranch:  s.options.SingleBranch,
-		Depth:         s.options.Depth,
-		Auth:          s.options.Auth,
-		Force:         true,
+	if err != nil {
+		log.Error("failed to synchronize", zap.String("url", s.options.URL), zap.Error(err))
+	}
+
+	return err
+}
+
+func (s *Service) sync(ctx context.Context) error {
+	upstream := s.Upstream()
+
+	if s.constraint != nil {
+		// the selected tag is only reported once it is being served
+		selected, err := s.constraint.Select(ctx, s.options.URL, s.options.Auth)
+		if err != nil {
+			return err
+		}
+
+		upstream = selected
+	}
+
+	err := s.Repository.FetchContext(ctx, &git.FetchOptions{
+		RefSpecs: []config.RefSpec{
+			config.RefSpec(fmt.Sprintf("+%s:%s", upstream, tracking(upstream))),
+		},
+		Depth: s.options.Depth,
+		Auth:  s.options.Auth,
+		Tags:  s.options.Tags,
+		Force: true,
 	})
 
 	switch {
 	case errors.Is(err, git.NoErrAlreadyUpToDate):
 	case err != nil:
-		zaputil.Extract(ctx).Error("failed to pull", zap.Error(err))
+		return errors.Wrap(err, "failed to fetch")
+	}
+
+	return s.update(ctx, upstream)
+}
+
+// record updates the SyncState of the service given the outcome of an attempt.
+func (s *Service) record(start, end time.Time, err error) {
+	if s.observe != nil {
+		s.observe(end.Sub(start))
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.state.LastAttempt = start
+	s.state.Duration = end.Sub(start)
+	s.state.Error = ""
+
+	if err != nil {
+		s.state.Failures++
+		s.state.Error = err.Error()
+		return
+	}
+
+	s.state.LastSuccess = end
+	s.state.Failures = 0
+}
+
+// update checks out the commit the provided upstream reference points to and swaps it in as the current revision. The
+// upstream is recorded as the reference being served once the swap succeeds. Requests that are still reading from the
+// previous revision continue to do so until they complete.
+func (s *Service) update(ctx context.Context, upstream plumbing.ReferenceName) error {
+	hash, err := s.Repository.ResolveRevision(plumbing.Revision(tracking(upstream)))
+	if err != nil {
+		return errors.Wrap(err, "failed to resolve reference")
+	}
+
+	err = s.swap(ctx, *hash)
+	if err != nil {
+		return err
 	}
 
+	s.mu.Lock()
+	s.upstream = upstream
+	s.mu.Unlock()
+
 	return nil
 }
+
+// swap checks out the provided commit and swaps it in as the current revision.
+func (s *Service) swap(ctx context.Context, hash plumbing.Hash) error {
+	s.mu.RLock()
+	current := s.current
+	s.mu.RUnlock()
+
+	if current != nil && current.hash == hash {
+		return nil
+	}
+
+	commit, err := s.Repository.CommitObject(hash)
+	if err != nil {
+		return errors.Wrap(err, "failed to read commit")
+	}
+
+	next, err := checkout(s.dir, s.root, commit, current)
+	if err != nil {
+		return err
+	}
+
+	log := zaputil.Extract(ctx)
+	log.Info("checked out", zap.String("url", s.options.URL), zap.String("commit", hash.String()))
+
+	// problems with the rule files are surfaced through the sync state rather than failing the update
+	var warnings []string
+	next.rules, warnings = loadRules(next.fs)
+
+	if len(warnings) > 0 {
+		log.Warn("invalid site rules", zap.String("url", s.options.URL), zap.Strings("warnings", warnings))
+	}
+
+	s.mu.Lock()
+	if s.closed {
+		// the service was closed while the revision was being checked out
+		s.mu.Unlock()
+		next.retire()
+		return nil
+	}
+
+	s.current = next
+	s.state.Warnings = warnings
+	s.mu.Unlock()
+
+	if current != nil {
+		current.retire()
+	}
+
+	return nil
+}
+
+// Upstream returns the remote reference (e.g. refs/heads/main or refs/tags/v1.0.0) that is currently being served.
+func (s *Service) Upstream() plumbing.ReferenceName {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.upstream
+}
+
+// Tag returns the name of the tag currently being served, if any.
+func (s *Service) Tag() string {
+	if upstream := s.Upstream(); upstream.IsTag() {
+		return upstream.Short()
+	}
+
+	return ""
+}
+
+// Commit returns the hash of the commit currently being served.
+func (s *Service) Commit() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.current == nil {
+		return ""
+	}
+
+	return s.current.hash.String()
+}
+
+// State returns the outcome of the most recent attempts to synchronize the repository.
+func (s *Service) State() SyncState {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.state
+}
+
+// Tracks returns true when the provided remote reference (e.g. refs/heads/main) is the one being served. When a tag
+// constraint is configured, any tag that satisfies the constraint is tracked.
+func (s *Service) Tracks(ref string) bool {
+	name := plumbing.ReferenceName(ref)
+	if s.constraint != nil {
+		return s.constraint.Matches(name)
+	}
+
+	upstream := s.Upstream()
+	return upstream != "" && name == upstream
+}
+
+// acquire returns the current revision, or nil when the service has no revision to serve (e.g. once it's been closed).
+// Callers must release the revision once they're done reading from it.
+func (s *Service) acquire() *revision {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.current == nil {
+		return nil
+	}
+
+	s.current.acquire()
+	return s.current
+}
+
+// Close retires the current revision and removes any object storage managed by the service from disk. The checkout
+// of the current revision is removed once requests still reading from it have released it.
+func (s *Service) Close() error {
+	s.mu.Lock()
+	current := s.current
+	s.current = nil
+	s.closed = true
+	s.mu.Unlock()
+
+	err := os.RemoveAll(filepath.Join(s.dir, "git"))
+
+	if current != nil {
+		current.retire()
+	} else {
+		_ = os.Remove(s.dir)
+	}
+
+	return err
+}
@@ -0,0 +1,83 @@
+// Copyright (C) 2022  The pages authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package git
+
+import (
+	"testing"
+
+	"github.com/go-git/go-billy/v5/memfs"
+)
+
+func TestHiddenConfig(t *testing.T) {
+	testCases := []struct {
+		name    string
+		config  HiddenConfig
+		visible map[string]bool
+	}{
+		{
+			name:   "default allow list",
+			config: HiddenConfig{Allow: ".well-known"},
+			visible: map[string]bool{
+				".well-known/security.txt": true,
+				".git/config":              false,
+				"index.html":               true,
+			},
+		},
+		{
+			name:   "empty allow list",
+			config: HiddenConfig{},
+			visible: map[string]bool{
+				".well-known/security.txt": false,
+				".git/config":              false,
+				"index.html":               true,
+			},
+		},
+		{
+			name:   "multiple entries",
+			config: HiddenConfig{Allow: ".well-known,,.git"},
+			visible: map[string]bool{
+				".well-known/security.txt": true,
+				".git/config":              true,
+				"index.html":               true,
+			},
+		},
+		{
+			name:   "serve hidden",
+			config: HiddenConfig{Serve: true},
+			visible: map[string]bool{
+				".well-known/security.txt": true,
+				".git/config":              true,
+				"index.html":               true,
+			},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			f := &httpFS{fs: memfs.New(), allowHidden: make(map[string]bool)}
+			for _, opt := range testCase.config.options() {
+				opt(f)
+			}
+
+			for name, expected := range testCase.visible {
+				if visible := f.visible(name); visible != expected {
+					t.Fatalf("expected visible(%q) to be %t, got %t", name, expected, visible)
+				}
+			}
+		})
+	}
+}
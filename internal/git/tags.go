@@ -0,0 +1,99 @@
+// Copyright (C) 2022  The pages authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package git
+
+import (
+	"context"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/storage/memory"
+	"github.com/pkg/errors"
+)
+
+// ErrNoMatchingTag is returned when none of the remote tags satisfy the configured tag constraint.
+var ErrNoMatchingTag = errors.New("no tag matches constraint")
+
+// parseTagConstraint parses the provided semantic version constraint. The special value "latest" matches the highest
+// stable release.
+func parseTagConstraint(expr string) (*tagConstraint, error) {
+	if expr == "latest" {
+		expr = "*"
+	}
+
+	constraints, err := semver.NewConstraint(expr)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse tag constraint")
+	}
+
+	return &tagConstraint{constraints}, nil
+}
+
+// tagConstraint selects the highest semantic version tag that satisfies a constraint.
+type tagConstraint struct {
+	constraints *semver.Constraints
+}
+
+// Matches returns true if the provided tag reference satisfies the constraint.
+func (c *tagConstraint) Matches(ref plumbing.ReferenceName) bool {
+	if !ref.IsTag() {
+		return false
+	}
+
+	version, err := semver.NewVersion(ref.Short())
+	return err == nil && c.constraints.Check(version)
+}
+
+// Select lists the tags of the remote repository and returns the highest one that satisfies the constraint.
+func (c *tagConstraint) Select(ctx context.Context, url string, auth transport.AuthMethod) (plumbing.ReferenceName, error) {
+	remote := git.NewRemote(memory.NewStorage(), &config.RemoteConfig{
+		Name: git.DefaultRemoteName,
+		URLs: []string{url},
+	})
+
+	refs, err := remote.ListContext(ctx, &git.ListOptions{Auth: auth})
+	if err != nil {
+		return "", errors.Wrap(err, "failed to list tags")
+	}
+
+	var (
+		selected plumbing.ReferenceName
+		highest  *semver.Version
+	)
+
+	for _, ref := range refs {
+		name := ref.Name()
+		if !c.Matches(name) {
+			continue
+		}
+
+		version, _ := semver.NewVersion(name.Short())
+		if highest == nil || version.GreaterThan(highest) {
+			selected = name
+			highest = version
+		}
+	}
+
+	if highest == nil {
+		return "", ErrNoMatchingTag
+	}
+
+	return selected, nil
+}
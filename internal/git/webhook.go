@@ -0,0 +1,143 @@
+// Copyright (C) 2022  The pages authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package git
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+
+	"github.com/mjpitz/myago/zaputil"
+)
+
+// maxWebhookPayload caps the size of the payload that will be read from a webhook delivery.
+const maxWebhookPayload = 25 << 20
+
+const (
+	eventPush = "push"
+	eventPing = "ping"
+)
+
+// verifyWebhook checks the signature of the delivery using the provided secret and returns the normalized event type.
+// GitHub and Gitea sign the payload with an HMAC-SHA256 while GitLab sends the secret token as-is.
+func verifyWebhook(header http.Header, body []byte, secret string) (event string, ok bool) {
+	switch {
+	case header.Get("X-Gitea-Signature") != "":
+		return strings.ToLower(header.Get("X-Gitea-Event")),
+			validMAC(header.Get("X-Gitea-Signature"), body, secret)
+
+	case header.Get("X-Hub-Signature-256") != "":
+		signature := strings.TrimPrefix(header.Get("X-Hub-Signature-256"), "sha256=")
+
+		return strings.ToLower(header.Get("X-GitHub-Event")),
+			validMAC(signature, body, secret)
+
+	case header.Get("X-Gitlab-Token") != "":
+		event := ""
+		switch header.Get("X-Gitlab-Event") {
+		case "Push Hook", "Tag Push Hook":
+			event = eventPush
+		}
+
+		return event, subtle.ConstantTimeCompare([]byte(header.Get("X-Gitlab-Token")), []byte(secret)) == 1
+	}
+
+	return "", false
+}
+
+func validMAC(signature string, body []byte, secret string) bool {
+	actual, err := hex.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	_, _ = mac.Write(body)
+
+	return hmac.Equal(actual, mac.Sum(nil))
+}
+
+// pushEvent contains the portion of a push payload that is common between GitHub, Gitea, and GitLab.
+type pushEvent struct {
+	Ref string `json:"ref"`
+}
+
+// Webhook receives push events from GitHub, Gitea, and GitLab and synchronizes the associated site when the pushed
+// reference is the one being served. The site is synchronized in the background once the delivery has been verified,
+// and failures are reported through its sync state. Sites without a webhook secret do not accept deliveries.
+func (e *Endpoint) Webhook(w http.ResponseWriter, r *http.Request) {
+	log := zaputil.Extract(r.Context())
+	entry := e.lookupSite(r)
+
+	if entry == nil || entry.config.WebhookSecret == "" {
+		http.Error(w, "", http.StatusNotFound)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxWebhookPayload))
+	if err != nil {
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+
+	event, ok := verifyWebhook(r.Header, body, entry.config.WebhookSecret)
+
+	switch {
+	case !ok:
+		http.Error(w, "", http.StatusUnauthorized)
+		return
+	case event == eventPing:
+		w.WriteHeader(http.StatusOK)
+		return
+	case event != eventPush:
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	push := pushEvent{}
+
+	err = json.Unmarshal(body, &push)
+	if err != nil {
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+
+	if !entry.service.Tracks(push.Ref) {
+		log.Debug("ignoring push", zap.String("url", entry.config.URL), zap.String("ref", push.Ref))
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	// deliveries time out long before large repositories finish synchronizing, so the sync outlives the request
+	go func() {
+		err := entry.sync(e.ctx)
+		if errors.Is(err, ErrReferenceNotFound) {
+			// the branch has been removed, drop the preview (no-op for configured sites)
+			e.evict(e.ctx, entry.domain)
+		}
+	}()
+
+	w.WriteHeader(http.StatusAccepted)
+}
@@ -0,0 +1,284 @@
+// Copyright (C) 2022  The pages authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package git
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+const (
+	testSecret  = "s3cret"
+	testPayload = `{"ref":"refs/heads/main"}`
+)
+
+func sign(body, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	_, _ = mac.Write([]byte(body))
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestVerifyWebhook(t *testing.T) {
+	testCases := []struct {
+		name   string
+		header map[string]string
+		event  string
+		ok     bool
+	}{
+		{
+			name: "github push",
+			header: map[string]string{
+				"X-GitHub-Event":      "push",
+				"X-Hub-Signature-256": "sha256=" + sign(testPayload, testSecret),
+			},
+			event: eventPush,
+			ok:    true,
+		},
+		{
+			name: "github ping",
+			header: map[string]string{
+				"X-GitHub-Event":      "ping",
+				"X-Hub-Signature-256": "sha256=" + sign(testPayload, testSecret),
+			},
+			event: eventPing,
+			ok:    true,
+		},
+		{
+			name: "github wrong secret",
+			header: map[string]string{
+				"X-GitHub-Event":      "push",
+				"X-Hub-Signature-256": "sha256=" + sign(testPayload, "wrong"),
+			},
+			event: eventPush,
+		},
+		{
+			name: "github malformed signature",
+			header: map[string]string{
+				"X-GitHub-Event":      "push",
+				"X-Hub-Signature-256": "sha256=not-hex",
+			},
+			event: eventPush,
+		},
+		{
+			name: "github legacy sha1 signature",
+			header: map[string]string{
+				"X-GitHub-Event":  "push",
+				"X-Hub-Signature": "sha1=" + sign(testPayload, testSecret),
+			},
+		},
+		{
+			name: "gitea push",
+			header: map[string]string{
+				"X-Gitea-Event":     "push",
+				"X-Gitea-Signature": sign(testPayload, testSecret),
+			},
+			event: eventPush,
+			ok:    true,
+		},
+		{
+			name: "gitea wrong secret",
+			header: map[string]string{
+				"X-Gitea-Event":     "push",
+				"X-Gitea-Signature": sign(testPayload, "wrong"),
+			},
+			event: eventPush,
+		},
+		{
+			name: "gitea signature of another payload",
+			header: map[string]string{
+				"X-Gitea-Event":     "push",
+				"X-Gitea-Signature": sign(`{"ref":"refs/heads/other"}`, testSecret),
+			},
+			event: eventPush,
+		},
+		{
+			name: "gitlab push",
+			header: map[string]string{
+				"X-Gitlab-Event": "Push Hook",
+				"X-Gitlab-Token": testSecret,
+			},
+			event: eventPush,
+			ok:    true,
+		},
+		{
+			name: "gitlab tag push",
+			header: map[string]string{
+				"X-Gitlab-Event": "Tag Push Hook",
+				"X-Gitlab-Token": testSecret,
+			},
+			event: eventPush,
+			ok:    true,
+		},
+		{
+			name: "gitlab other event",
+			header: map[string]string{
+				"X-Gitlab-Event": "Merge Request Hook",
+				"X-Gitlab-Token": testSecret,
+			},
+			ok: true,
+		},
+		{
+			name: "gitlab wrong token",
+			header: map[string]string{
+				"X-Gitlab-Event": "Push Hook",
+				"X-Gitlab-Token": "wrong",
+			},
+			event: eventPush,
+		},
+		{
+			name: "missing signature",
+			header: map[string]string{
+				"X-GitHub-Event": "push",
+			},
+		},
+		{
+			name:   "missing headers",
+			header: map[string]string{},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			header := make(http.Header)
+			for name, value := range testCase.header {
+				header.Set(name, value)
+			}
+
+			event, ok := verifyWebhook(header, []byte(testPayload), testSecret)
+			if ok != testCase.ok {
+				t.Fatalf("expected ok to be %t, got %t", testCase.ok, ok)
+			}
+
+			if ok && event != testCase.event {
+				t.Fatalf("expected event %q, got %q", testCase.event, event)
+			}
+		})
+	}
+}
+
+func TestWebhook(t *testing.T) {
+	site := &entry{
+		domain:  "example.com",
+		config:  Config{WebhookSecret: testSecret},
+		service: &Service{upstream: plumbing.NewBranchReferenceName("main")},
+	}
+
+	unsigned := &entry{
+		domain:  "unsigned.example.com",
+		service: &Service{upstream: plumbing.NewBranchReferenceName("main")},
+	}
+
+	endpoint := &Endpoint{
+		router: router{hosts: map[string]*entry{
+			site.domain:     site,
+			unsigned.domain: unsigned,
+		}},
+	}
+
+	other := `{"ref":"refs/heads/other"}`
+
+	testCases := []struct {
+		name   string
+		host   string
+		body   string
+		header map[string]string
+		status int
+	}{
+		{
+			name:   "unknown site",
+			host:   "unknown.example.com",
+			body:   testPayload,
+			header: map[string]string{"X-GitHub-Event": "push", "X-Hub-Signature-256": "sha256=" + sign(testPayload, testSecret)},
+			status: http.StatusNotFound,
+		},
+		{
+			name:   "site without a secret",
+			host:   unsigned.domain,
+			body:   testPayload,
+			header: map[string]string{"X-GitHub-Event": "push", "X-Hub-Signature-256": "sha256=" + sign(testPayload, "")},
+			status: http.StatusNotFound,
+		},
+		{
+			name:   "missing signature",
+			host:   site.domain,
+			body:   testPayload,
+			header: map[string]string{"X-GitHub-Event": "push"},
+			status: http.StatusUnauthorized,
+		},
+		{
+			name:   "invalid signature",
+			host:   site.domain,
+			body:   testPayload,
+			header: map[string]string{"X-GitHub-Event": "push", "X-Hub-Signature-256": "sha256=" + sign(testPayload, "wrong")},
+			status: http.StatusUnauthorized,
+		},
+		{
+			name:   "ping",
+			host:   site.domain,
+			body:   `{"zen":"Keep it logically awesome."}`,
+			header: map[string]string{"X-GitHub-Event": "ping", "X-Hub-Signature-256": "sha256=" + sign(`{"zen":"Keep it logically awesome."}`, testSecret)},
+			status: http.StatusOK,
+		},
+		{
+			name:   "unsupported event",
+			host:   site.domain,
+			body:   testPayload,
+			header: map[string]string{"X-GitHub-Event": "issues", "X-Hub-Signature-256": "sha256=" + sign(testPayload, testSecret)},
+			status: http.StatusAccepted,
+		},
+		{
+			name:   "malformed payload",
+			host:   site.domain,
+			body:   "{",
+			header: map[string]string{"X-GitHub-Event": "push", "X-Hub-Signature-256": "sha256=" + sign("{", testSecret)},
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "push to an untracked branch",
+			host:   site.domain,
+			body:   other,
+			header: map[string]string{"X-Gitea-Event": "push", "X-Gitea-Signature": sign(other, testSecret)},
+			status: http.StatusAccepted,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/_webhook", strings.NewReader(testCase.body))
+			r.Host = testCase.host
+
+			for name, value := range testCase.header {
+				r.Header.Set(name, value)
+			}
+
+			w := httptest.NewRecorder()
+			endpoint.Webhook(w, r)
+
+			if w.Code != testCase.status {
+				t.Fatalf("expected status %d, got %d", testCase.status, w.Code)
+			}
+		})
+	}
+}
@@ -24,6 +24,8 @@ import (
 var (
 	namespace = "pages"
 	page      = "page"
+	site      = "site"
+	cache     = "cache"
 
 	// by default, summaries give us counts and sums which we can use to compute an average (not great, but it can work)
 	// in addition to the default information, we report on the following quantiles:
@@ -68,4 +70,115 @@ var (
 		},
 		[]string{"domain", "path", "country"},
 	)
+
+	// SiteTag reports the tag currently being served by a site.
+	SiteTag = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: site,
+			Name:      "tag",
+			Help:      "the tag currently being served for a given site",
+		},
+		[]string{"domain", "tag"},
+	)
+
+	// SiteCommit reports the commit currently being served by a site.
+	SiteCommit = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: site,
+			Name:      "commit",
+			Help:      "the commit currently being served for a given site",
+		},
+		[]string{"domain", "commit"},
+	)
+
+	// SiteLastSyncAttempt reports when a site last attempted to synchronize with its repository.
+	SiteLastSyncAttempt = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: site,
+			Name:      "last_sync_attempt_timestamp_seconds",
+			Help:      "the unix time of the last attempt to synchronize a given site",
+		},
+		[]string{"domain"},
+	)
+
+	// SiteLastSyncSuccess reports when a site last synchronized with its repository successfully.
+	SiteLastSyncSuccess = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: site,
+			Name:      "last_sync_success_timestamp_seconds",
+			Help:      "the unix time of the last successful synchronization of a given site",
+		},
+		[]string{"domain"},
+	)
+
+	// SiteSyncFailures reports the number of consecutive failed attempts to synchronize a site.
+	SiteSyncFailures = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: site,
+			Name:      "sync_consecutive_failures",
+			Help:      "the number of consecutive failures to synchronize a given site",
+		},
+		[]string{"domain"},
+	)
+
+	// SiteSyncDuration tracks how long it takes to synchronize a site.
+	SiteSyncDuration = promauto.NewSummaryVec(
+		prometheus.SummaryOpts{
+			Namespace:  namespace,
+			Subsystem:  site,
+			Name:       "sync_seconds",
+			Help:       "how long it took to synchronize a given site",
+			Objectives: defaultObjectives,
+		},
+		[]string{"domain"},
+	)
+
+	// CacheHits counts the number of files served from the in-memory content cache.
+	CacheHits = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: cache,
+			Name:      "hits_total",
+			Help:      "the number of files of a given site that were served from memory",
+		},
+		[]string{"domain"},
+	)
+
+	// CacheMisses counts the number of files that had to be read from disk.
+	CacheMisses = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: cache,
+			Name:      "misses_total",
+			Help:      "the number of files of a given site that were read from disk",
+		},
+		[]string{"domain"},
+	)
+
+	// CacheEvictions counts the number of files removed from the cache to make room for others.
+	CacheEvictions = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: cache,
+			Name:      "evictions_total",
+			Help:      "the number of files of a given site that were evicted from memory to make room for others",
+		},
+		[]string{"domain"},
+	)
+
+	// CacheBytes reports the size of the file contents held in the cache.
+	CacheBytes = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: cache,
+			Name:      "bytes",
+			Help:      "the number of bytes of a given site that are held in memory",
+		},
+		[]string{"domain"},
+	)
 )
@@ -77,7 +77,8 @@ func Middleware(opts ...Option) mux.MiddlewareFunc {
 
 			d := &writer{w, http.StatusOK}
 			defer func() {
-				if d.statusCode != http.StatusNotFound {
+				// redirects are counted once the client arrives at the destination
+				if d.statusCode != http.StatusNotFound && !isRedirect(d.statusCode) {
 					metrics.PageViewCount.WithLabelValues(domain, path, referrer, info.CountryCode).Inc()
 				}
 			}()
@@ -87,6 +88,10 @@ func Middleware(opts ...Option) mux.MiddlewareFunc {
 	}
 }
 
+func isRedirect(statusCode int) bool {
+	return statusCode >= http.StatusMultipleChoices && statusCode < http.StatusBadRequest && statusCode != http.StatusNotModified
+}
+
 type writer struct {
 	writer     http.ResponseWriter
 	statusCode int
@@ -18,14 +18,20 @@ package internal
 
 import (
 	"context"
+	"crypto/tls"
 	"net"
 	"net/http"
+	"strings"
 
 	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/crypto/acme/autocert"
 	"golang.org/x/sync/errgroup"
 
+	"code.pitz.tech/mya/pages/internal/acme"
+	"code.pitz.tech/mya/pages/internal/compress"
 	"code.pitz.tech/mya/pages/internal/excludes"
 	"code.pitz.tech/mya/pages/internal/geoip"
 	"code.pitz.tech/mya/pages/internal/pageviews"
@@ -46,28 +52,102 @@ type AdminConfig struct {
 	Password string `json:"password" usage:"specify the password used to authenticate requests with the admin endpoints"`
 }
 
-// BindConfig defines the set of configuration options for setting up a server.
+// WebhookConfig encapsulates configuration for the webhook endpoint.
+type WebhookConfig struct {
+	Prefix string `json:"prefix" usage:"configure the prefix to use for receiving webhooks" default:"/_webhook" hidden:"true"`
+}
+
+// BindConfig defines the set of configuration options for setting up a server. When its TLS is not enabled, the server
+// uses the TLS configuration shared by both servers.
 type BindConfig struct {
-	Address string `json:"address" usage:"configure the bind address for the server"`
+	Address    string         `json:"address"     usage:"configure the bind address for the server"`
+	TLS        livetls.Config `json:"tls"`
+	ClientAuth bool           `json:"client_auth" usage:"require clients to present a certificate signed by the tls ca"`
+}
+
+// RedirectConfig defines the set of configuration options for the plain HTTP server that redirects to HTTPS.
+type RedirectConfig struct {
+	Address string `json:"address" usage:"configure the bind address for the server that redirects plain HTTP requests to HTTPS"`
 }
 
 // ServerConfig defines configuration for a public and private interface.
 type ServerConfig struct {
-	Admin   AdminConfig    `json:"admin"`
-	GeoIP   geoip.Config   `json:"geoip"`
-	Session session.Config `json:"session"`
-	TLS     livetls.Config `json:"tls"`
-	Public  BindConfig     `json:"public"`
-	Private BindConfig     `json:"private"`
+	Admin       AdminConfig     `json:"admin"`
+	GeoIP       geoip.Config    `json:"geoip"`
+	Session     session.Config  `json:"session"`
+	Compression compress.Config `json:"compression"`
+	Webhook     WebhookConfig   `json:"webhook"`
+	TLS         livetls.Config  `json:"tls"`
+	ACME        acme.Config     `json:"acme"`
+	Public      BindConfig      `json:"public"`
+	Private     BindConfig      `json:"private"`
+	HTTP        RedirectConfig  `json:"http"`
+}
+
+// bindTLS returns the TLS configuration used by the provided server.
+func (c ServerConfig) bindTLS(bind BindConfig) livetls.Config {
+	if bind.TLS.Enable {
+		return bind.TLS
+	}
+
+	return c.TLS
+}
+
+// PublicTLS returns true when the public server accepts HTTPS requests, either using the configured certificates or
+// those obtained using ACME.
+func (c ServerConfig) PublicTLS() bool {
+	return c.bindTLS(c.Public).Enable || c.ACME.Enable
 }
 
 // NewServer constructs a Server from it's associated configuration.
 func NewServer(ctx context.Context, config ServerConfig) (*Server, error) {
-	tls, err := livetls.New(ctx, config.TLS)
+	publicTLS, err := listenerTLS(ctx, config.Public.Address, config.bindTLS(config.Public), config.Public.ClientAuth)
+	if err != nil {
+		return nil, err
+	}
+
+	privateTLS, err := listenerTLS(ctx, config.Private.Address, config.bindTLS(config.Private), config.Private.ClientAuth)
+	if err != nil {
+		return nil, err
+	}
+
+	manager, err := acme.New(config.ACME)
 	if err != nil {
 		return nil, err
 	}
 
+	var redirect http.Handler
+
+	if config.HTTP.Address != "" {
+		if !config.PublicTLS() {
+			return nil, errors.Errorf("redirecting %s to HTTPS requires tls or acme to be enabled for the public server", config.HTTP.Address)
+		}
+
+		_, port, _ := net.SplitHostPort(config.Public.Address)
+		redirect = redirectHTTPS(port)
+	}
+
+	if manager != nil {
+		publicTLS = acme.TLSConfig(manager, publicTLS)
+
+		if redirect != nil {
+			// HTTP-01 challenges are answered before redirecting, TLS-ALPN-01 challenges are answered by the public server
+			redirect = manager.HTTPHandler(redirect)
+		}
+	}
+
+	var insecure *http.Server
+
+	if redirect != nil {
+		insecure = &http.Server{
+			Addr:    config.HTTP.Address,
+			Handler: redirect,
+			BaseContext: func(l net.Listener) context.Context {
+				return ctx
+			},
+		}
+	}
+
 	ipdb, err := config.GeoIP.Open()
 	if err != nil {
 		return nil, err
@@ -80,9 +160,21 @@ func NewServer(ctx context.Context, config ServerConfig) (*Server, error) {
 		excludes.AssetExclusion(),
 		excludes.PrefixExclusion(config.Admin.Prefix),
 		excludes.PrefixExclusion(config.Session.Prefix),
+		excludes.PrefixExclusion(config.Webhook.Prefix),
 	}
 
 	public := mux.NewRouter()
+
+	if config.Compression.Enable {
+		// compression is applied last so that it operates on the final response (e.g. after script injection)
+		public.Use(
+			compress.Middleware(
+				compress.MinSize(config.Compression.MinSize),
+				compress.Exclusions(excludes.PrefixExclusion(config.Session.Prefix)),
+			),
+		)
+	}
+
 	public.Use(
 		func(next http.Handler) http.Handler { return headers.HTTP(next) },
 		geoip.Middleware(ipdb),
@@ -119,10 +211,12 @@ func NewServer(ctx context.Context, config ServerConfig) (*Server, error) {
 
 	return &Server{
 		AdminMux: admin,
+		ACME:     manager,
+		HTTP:     insecure,
 
 		PublicMux: public,
 		Public: &http.Server{
-			TLSConfig: tls,
+			TLSConfig: publicTLS,
 			Addr:      config.Public.Address,
 			Handler:   promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer, public),
 			BaseContext: func(l net.Listener) context.Context {
@@ -132,7 +226,7 @@ func NewServer(ctx context.Context, config ServerConfig) (*Server, error) {
 
 		PrivateMux: private,
 		Private: &http.Server{
-			TLSConfig: tls,
+			TLSConfig: privateTLS,
 			Addr:      config.Private.Address,
 			Handler:   promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer, private),
 			BaseContext: func(l net.Listener) context.Context {
@@ -142,9 +236,63 @@ func NewServer(ctx context.Context, config ServerConfig) (*Server, error) {
 	}, nil
 }
 
-// Server hosts a Public and Private HTTP server.
+// listenerTLS constructs the tls.Config used by a server. Certificates are reloaded from disk as they change. Nil is
+// returned when the server does not have TLS enabled.
+func listenerTLS(ctx context.Context, address string, config livetls.Config, clientAuth bool) (*tls.Config, error) {
+	tlsConfig, err := livetls.New(ctx, config)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to load tls configuration for %s", address)
+	}
+
+	if clientAuth {
+		if tlsConfig == nil || tlsConfig.ClientCAs == nil {
+			return nil, errors.Errorf("client_auth for %s requires tls to be enabled with a ca", address)
+		}
+
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return tlsConfig, nil
+}
+
+// redirectHTTPS permanently redirects requests to the same host and path using HTTPS. The port is omitted from the
+// location when it is empty or the default. Requests using methods other than GET or HEAD are sent a 308 so that
+// clients repeat them with the same method and body.
+func redirectHTTPS(port string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		} else {
+			host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+		}
+
+		if host == "" {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+
+		status := http.StatusMovedPermanently
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			status = http.StatusPermanentRedirect
+		}
+
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), status)
+	})
+}
+
+// Server hosts a Public and Private HTTP server, each of which is served over TLS when it has a TLSConfig. An optional
+// plain HTTP server redirects clients to the Public server using HTTPS and answers ACME HTTP-01 challenges.
 type Server struct {
 	AdminMux   *mux.Router
+	ACME       *autocert.Manager
+	HTTP       *http.Server
 	PublicMux  *mux.Router
 	Public     *http.Server
 	PrivateMux *mux.Router
@@ -156,14 +304,31 @@ func (s *Server) Shutdown(ctx context.Context) error {
 	_ = s.Public.Shutdown(ctx)
 	_ = s.Private.Shutdown(ctx)
 
+	if s.HTTP != nil {
+		_ = s.HTTP.Shutdown(ctx)
+	}
+
 	return nil
 }
 
 // ListenAndServe starts underlying Public and Private HTTP servers.
 func (s *Server) ListenAndServe() error {
 	var group errgroup.Group
-	group.Go(s.Public.ListenAndServe)
-	group.Go(s.Private.ListenAndServe)
+	group.Go(func() error { return listenAndServe(s.Public) })
+	group.Go(func() error { return listenAndServe(s.Private) })
+
+	if s.HTTP != nil {
+		group.Go(s.HTTP.ListenAndServe)
+	}
 
 	return group.Wait()
 }
+
+// listenAndServe serves TLS when the server has a TLSConfig. Certificates are obtained from its GetCertificate.
+func listenAndServe(server *http.Server) error {
+	if server.TLSConfig != nil {
+		return server.ListenAndServeTLS("", "")
+	}
+
+	return server.ListenAndServe()
+}
@@ -71,6 +71,12 @@ func Middleware(opts ...Option) mux.MiddlewareFunc {
 				return
 			}
 
+			// the response must not be encoded for the script to be injected, compression happens further up the chain
+			if r.Header.Get("Accept-Encoding") != "" {
+				r = r.Clone(r.Context())
+				r.Header.Del("Accept-Encoding")
+			}
+
 			buffer := &bufferedResponseWriter{
 				header: http.Header{},
 				status: http.StatusOK,
@@ -0,0 +1,131 @@
+// Copyright (C) 2022  The pages authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package web
+
+import (
+	_ "embed"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+//go:embed pages/listing.html
+var listinghtml string
+
+var listingPage = template.Must(template.New("listing").Funcs(template.FuncMap{"size": size}).Parse(listinghtml))
+
+// ListingEntry describes a single file or directory within a directory listing.
+type ListingEntry struct {
+	Name    string
+	Dir     bool
+	Size    int64
+	ModTime time.Time
+}
+
+// Link returns the escaped, relative link to the entry.
+func (e ListingEntry) Link() string {
+	link := url.URL{Path: e.Name}
+	if e.Dir {
+		return link.String() + "/"
+	}
+
+	return link.String()
+}
+
+type listing struct {
+	Path    string
+	Base    string
+	Sort    string
+	Order   string
+	Entries []ListingEntry
+}
+
+// Toggle returns the order a column should be sorted by when its header is selected.
+func (l listing) Toggle(column string) string {
+	if l.Sort == column && l.Order == "asc" {
+		return "desc"
+	}
+
+	return "asc"
+}
+
+// Listing renders a styled listing of a directory. Entries can be sorted by name, size, or modification time using the
+// sort and order query parameters. Directories are always listed first. Links are made relative to base, which allows
+// directories to be served without a trailing slash.
+func Listing(w http.ResponseWriter, r *http.Request, base string, entries []ListingEntry) {
+	query := r.URL.Query()
+
+	l := listing{
+		Path:    r.URL.Path,
+		Base:    base,
+		Sort:    query.Get("sort"),
+		Order:   query.Get("order"),
+		Entries: entries,
+	}
+
+	var less func(a, b ListingEntry) bool
+
+	switch l.Sort {
+	case "size":
+		less = func(a, b ListingEntry) bool { return a.Size < b.Size }
+	case "modified":
+		less = func(a, b ListingEntry) bool { return a.ModTime.Before(b.ModTime) }
+	default:
+		l.Sort = "name"
+		less = func(a, b ListingEntry) bool { return strings.ToLower(a.Name) < strings.ToLower(b.Name) }
+	}
+
+	if l.Order != "desc" {
+		l.Order = "asc"
+	}
+
+	sort.SliceStable(l.Entries, func(i, j int) bool {
+		a, b := l.Entries[i], l.Entries[j]
+
+		switch {
+		case a.Dir != b.Dir:
+			return a.Dir
+		case l.Order == "desc":
+			return less(b, a)
+		default:
+			return less(a, b)
+		}
+	})
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_ = listingPage.Execute(w, l)
+}
+
+// size formats the provided number of bytes for display.
+func size(bytes int64) string {
+	const unit = 1024
+	if bytes < unit {
+		return fmt.Sprintf("%d B", bytes)
+	}
+
+	div, exp := int64(unit), 0
+	for n := bytes / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", float64(bytes)/float64(div), "KMGTPE"[exp])
+}
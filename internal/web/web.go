@@ -18,6 +18,7 @@ package web
 
 import (
 	_ "embed"
+	"html/template"
 	"net/http"
 	"strings"
 	"time"
@@ -29,6 +30,11 @@ import (
 //go:embed dist/pages.js
 var pagesjs string
 
+//go:embed pages/error.html
+var errorhtml string
+
+var errorPage = template.Must(template.New("error").Parse(errorhtml))
+
 func Handler() http.HandlerFunc {
 	start := time.Now()
 
@@ -36,3 +42,18 @@ func Handler() http.HandlerFunc {
 		http.ServeContent(w, r, "pages.js", start, strings.NewReader(pagesjs))
 	}
 }
+
+// Error renders the default error page for the provided status code.
+func Error(w http.ResponseWriter, status int) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+
+	_ = errorPage.Execute(w, struct {
+		Status int
+		Text   string
+	}{
+		Status: status,
+		Text:   http.StatusText(status),
+	})
+}